@@ -4,9 +4,22 @@ package goqite
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	mathrand "math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	internalsql "github.com/maragudk/goqite/internal/sql"
@@ -15,15 +28,62 @@ import (
 //go:embed schema.sql
 var schema string
 
-// rfc3339Milli is like time.RFC3339Nano, but with millisecond precision, and fractional seconds do not have trailing
-// zeros removed.
-const rfc3339Milli = "2006-01-02T15:04:05.000Z07:00"
+// rfc3339Milli is the timestamp format of the schema, see [internalsql.RFC3339Milli].
+const rfc3339Milli = internalsql.RFC3339Milli
 
 type NewOpts struct {
-	DB         *sql.DB
-	MaxReceive int // Max receive count for messages before they cannot be received anymore.
-	Name       string
+	// AutoSetup makes New create the schema with [Setup] if the goqite table doesn't exist yet.
+	// It requires permission to create tables, so it is off by default. New panics if the setup fails.
+	AutoSetup      bool
+	BusyRetries    int           // How many times to retry an operation if the database is busy or locked.
+	BusyRetryDelay time.Duration // Delay before the first busy retry, doubled for each subsequent retry.
+	// CorruptQueue is where messages with a body failing the checksum check are moved to on receive,
+	// like with [Queue.Archive]. It requires VerifyChecksum. Empty means they stay in the queue.
+	CorruptQueue string
+	DB           *sql.DB
+	// DedupBody makes sends with the same body as a message already in the queue return the ID of that message instead
+	// of sending a new one. Bodies are compared by SHA-256 hash. Only messages sent within DedupBodyWindow count,
+	// where zero means forever. It also applies to [Queue.SendIdempotent], after checking the dedup key.
+	DedupBody       bool
+	DedupBodyWindow time.Duration
+	DedupWindow     time.Duration // How long a dedup key is considered for deduplication after sending. Zero means forever.
+	IDFunc          func() ID     // Generates message IDs in Go instead of using the schema default.
+	IDPrefix        string        // Prefix for message IDs generated in Go instead of the schema default "m_".
+	Log             logger        // Logs configuration warnings, and panics in transaction callbacks, like in [Queue.Outbox].
+	MaxDepth        int           // Max number of messages in the queue, after which sends return ErrQueueFull. Zero means no limit.
+	MaxReceive      int           // Max receive count for messages before they cannot be received anymore.
+	Name            string
+	Producer        string // Identifies the sender, stored with sent messages and set as [Message.Producer] when received.
+	// QueryHook is called after every SQL statement run by the queue, with the query, its arguments, how long it took,
+	// and its error, if any. Use it to log slow queries or for profiling. For queries returning multiple rows, the
+	// duration doesn't include reading the rows.
+	QueryHook func(query string, args []any, d time.Duration, err error)
+	// ReceiveFilter is an SQL boolean expression on goqite table columns that messages must match to be received,
+	// for example "created <= strftime('%Y-%m-%dT%H:%M:%fZ', 'now', '-1 minute')". Use ? placeholders with
+	// ReceiveFilterArgs for values, never string formatting, to avoid SQL injection.
+	ReceiveFilter     string
+	ReceiveFilterArgs []any
+	// RedeliveryJitter adds a random duration between zero and RedeliveryJitter to the timeout of received messages,
+	// so messages received together and not deleted, for example after a mass failure, are not redelivered together.
+	// Zero means no jitter.
+	RedeliveryJitter time.Duration
+	// SingleConsumer hints that the queue has a single consumer, so receives can look up the next message and then
+	// claim it by ID in two simple statements, instead of one update with a subquery. If the hint is wrong, concurrent
+	// receives are still correct, because the claim checks again that the message can be received, but a receive may
+	// find no message when another consumer got to it first.
+	SingleConsumer bool
+	// StrictFIFO makes the queue deliver messages strictly in order, for a single consumer: while the oldest message
+	// is in flight or delayed, no later messages are received. Messages that have reached MaxReceive no longer block.
+	StrictFIFO bool
 	Timeout    time.Duration // Default timeout for messages before they can be re-received.
+	// Tombstone makes Delete mark messages as deleted instead of removing them, which is friendlier to replication tools
+	// that struggle with many deletes. Deleted messages are never received. Remove them with [Queue.Compact].
+	Tombstone bool
+	Validate  func(m Message) error // Called before sending a message, which is not sent if it returns an error. See [ValidationError].
+	// VerifyChecksum stores a CRC-32 checksum of the body of sent messages, and verifies it when receiving them, to
+	// detect corruption in the database. Receiving a message with a body that doesn't match returns [ErrCorrupt]
+	// instead of the message. Messages sent without a checksum are not verified.
+	VerifyChecksum bool
 }
 
 // New Queue with the given options.
@@ -31,6 +91,8 @@ type NewOpts struct {
 // - Logs are discarded.
 // - Max receive count is 3.
 // - Timeout is five seconds.
+// - IDs are generated by the database.
+// - Busy operations are not retried. If retried, the first retry delay is 10 milliseconds.
 func New(opts NewOpts) *Queue {
 	if opts.DB == nil {
 		panic("db cannot be nil")
@@ -40,6 +102,17 @@ func New(opts NewOpts) *Queue {
 		panic("name cannot be empty")
 	}
 
+	if opts.Log == nil {
+		opts.Log = &discardLogger{}
+	}
+
+	// SQLite only allows one writer at a time, so more open connections lead to busy errors.
+	// The check is only advisory, because the database may be something else entirely behind database/sql.
+	if n := opts.DB.Stats().MaxOpenConnections; n != 1 {
+		opts.Log.Info("Database max open connections is not 1, which can lead to database locked errors with SQLite",
+			"maxOpenConnections", n)
+	}
+
 	if opts.MaxReceive < 0 {
 		panic("max receive cannot be negative")
 	}
@@ -56,19 +129,243 @@ func New(opts NewOpts) *Queue {
 		opts.Timeout = 5 * time.Second
 	}
 
+	if opts.MaxDepth < 0 {
+		panic("max depth cannot be negative")
+	}
+
+	if opts.DedupWindow < 0 {
+		panic("dedup window cannot be negative")
+	}
+
+	if opts.DedupBodyWindow < 0 {
+		panic("dedup body window cannot be negative")
+	}
+
+	if opts.BusyRetries < 0 {
+		panic("busy retries cannot be negative")
+	}
+
+	if opts.BusyRetryDelay < 0 {
+		panic("busy retry delay cannot be negative")
+	}
+
+	if opts.BusyRetryDelay == 0 {
+		opts.BusyRetryDelay = 10 * time.Millisecond
+	}
+
+	if opts.IDFunc != nil && opts.IDPrefix != "" {
+		panic("id func and id prefix cannot both be set")
+	}
+
+	for _, r := range opts.IDPrefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			panic("id prefix can only contain letters, digits, underscores, and hyphens")
+		}
+	}
+
+	if opts.RedeliveryJitter < 0 {
+		panic("redelivery jitter cannot be negative")
+	}
+
+	if opts.ReceiveFilter == "" && len(opts.ReceiveFilterArgs) > 0 {
+		panic("receive filter args given without receive filter")
+	}
+
+	if opts.CorruptQueue != "" && !opts.VerifyChecksum {
+		panic("corrupt queue given without verify checksum")
+	}
+
+	if opts.CorruptQueue != "" && opts.CorruptQueue == opts.Name {
+		panic("corrupt queue cannot be the same as the queue")
+	}
+
+	if opts.AutoSetup {
+		if err := autoSetup(context.Background(), opts.DB); err != nil {
+			panic("cannot set up schema: " + err.Error())
+		}
+	}
+
 	return &Queue{
-		db:         opts.DB,
-		name:       opts.Name,
-		maxReceive: opts.MaxReceive,
-		timeout:    opts.Timeout,
+		corruptQueue:    opts.CorruptQueue,
+		db:              opts.DB,
+		dedupBody:       opts.DedupBody,
+		dedupBodyWindow: opts.DedupBodyWindow,
+		dedupWindow:     opts.DedupWindow,
+		filter:          opts.ReceiveFilter,
+		filterArgs:      opts.ReceiveFilterArgs,
+		idFunc:          opts.IDFunc,
+		idPrefix:        opts.IDPrefix,
+		jitter:          opts.RedeliveryJitter,
+		maxDepth:        opts.MaxDepth,
+		maxReceive:      newMaxReceive(opts.MaxReceive),
+		name:            opts.Name,
+		producer:        opts.Producer,
+		queryHook:       opts.QueryHook,
+		singleConsumer:  opts.SingleConsumer,
+		stmts:           newStmtCache(),
+		strictFIFO:      opts.StrictFIFO,
+		timeout:         opts.Timeout,
+		tombstone:       opts.Tombstone,
+		validate:        opts.Validate,
+		verifyChecksum:  opts.VerifyChecksum,
+		txOpts: internalsql.InTxOpts{
+			BusyRetries:    opts.BusyRetries,
+			BusyRetryDelay: opts.BusyRetryDelay,
+			Log:            opts.Log,
+		},
 	}
 }
 
+// Queuer is the interface of the main [Queue] operations, for code that wants to depend on an interface instead of
+// *Queue, for example to use a fake queue in tests.
+type Queuer interface {
+	Send(ctx context.Context, m Message) error
+	SendAndGetID(ctx context.Context, m Message) (ID, error)
+	Receive(ctx context.Context, opts ...ReceiveOption) (*Message, error)
+	ReceiveAndWait(ctx context.Context, interval time.Duration) (*Message, error)
+	Extend(ctx context.Context, id ID, delay time.Duration) error
+	Nack(ctx context.Context, id ID) error
+	Delete(ctx context.Context, id ID) error
+}
+
+var _ Queuer = (*Queue)(nil)
+
 type Queue struct {
-	db         *sql.DB
-	maxReceive int
-	name       string
-	timeout    time.Duration
+	corruptQueue    string
+	db              *sql.DB
+	dedupBody       bool
+	dedupBodyWindow time.Duration
+	dedupWindow     time.Duration
+	filter          string
+	filterArgs      []any
+	idFunc          func() ID
+	idPrefix        string
+	jitter          time.Duration
+	maxDepth        int
+	maxReceive      *atomic.Int64 // Changed at runtime with SetMaxReceive
+	name            string
+	producer        string
+	queryHook       func(query string, args []any, d time.Duration, err error)
+	singleConsumer  bool
+	stmts           *stmtCache
+	strictFIFO      bool
+	timeout         time.Duration
+	tombstone       bool
+	txOpts          internalsql.InTxOpts
+	validate        func(m Message) error
+	verifyChecksum  bool
+}
+
+// QueueError wraps database errors from the send, receive, extend, and delete operations, adding the operation and
+// the queue name for context. Use [errors.Is] and [errors.As] to check for the underlying error.
+type QueueError struct {
+	Op    string
+	Queue string
+	Err   error
+}
+
+func (e *QueueError) Error() string {
+	return fmt.Sprintf("goqite: %v on queue %v: %v", e.Op, e.Queue, e.Err)
+}
+
+func (e *QueueError) Unwrap() error {
+	return e.Err
+}
+
+// wrapErr in a [QueueError] for the operation op, unless it's nil.
+// Only database errors are wrapped, not errors from invalid arguments. Errors from the [NewOpts.Validate] func are
+// wrapped in a [ValidationError] instead.
+func (q *Queue) wrapErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &QueueError{Op: op, Queue: q.name, Err: err}
+}
+
+// Name of the queue.
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// MaxReceive returns the max receive count for messages in the queue. See [NewOpts.MaxReceive].
+func (q *Queue) MaxReceive() int {
+	return int(q.maxReceive.Load())
+}
+
+// SetMaxReceive changes the max receive count for messages in the queue at runtime, for example to temporarily raise
+// the retry budget during an incident. It takes effect from the next receive, and is safe for concurrent use.
+// Messages that have been received the old maximum number of times become receivable again if n is larger.
+// Queues created with [Queue.Clone] before the change are not affected.
+func (q *Queue) SetMaxReceive(n int) {
+	if n <= 0 {
+		panic("max receive must be larger than zero")
+	}
+
+	q.maxReceive.Store(int64(n))
+}
+
+func newMaxReceive(n int) *atomic.Int64 {
+	var v atomic.Int64
+	v.Store(int64(n))
+	return &v
+}
+
+// Clone returns a new Queue with the same database, name, and options as q, except for the options overridden by opts.
+// Only Timeout and MaxReceive can be overridden, and only non-zero values override. They are validated like in [New].
+// Use it to give a specific consumer of the same queue a different timeout or max receive count.
+func (q *Queue) Clone(opts NewOpts) *Queue {
+	if opts.DB != nil || opts.Name != "" {
+		panic("db and name cannot be overridden")
+	}
+
+	if opts.MaxReceive < 0 {
+		panic("max receive cannot be negative")
+	}
+
+	if opts.Timeout < 0 {
+		panic("timeout cannot be negative")
+	}
+
+	c := *q
+	c.maxReceive = newMaxReceive(q.MaxReceive())
+	c.stmts = newStmtCache()
+	if opts.MaxReceive > 0 {
+		c.maxReceive = newMaxReceive(opts.MaxReceive)
+	}
+	if opts.Timeout > 0 {
+		c.timeout = opts.Timeout
+	}
+	return &c
+}
+
+// ErrNotFound is returned when a message with the given ID does not exist in the queue.
+var ErrNotFound = errors.New("not found")
+
+// ErrCorrupt is returned when receiving a message with a body that doesn't match its checksum.
+// See [NewOpts.VerifyChecksum].
+var ErrCorrupt = errors.New("corrupt message body")
+
+// ErrQueueFull is returned when sending a message to a queue that already holds [NewOpts.MaxDepth] messages.
+var ErrQueueFull = errors.New("queue full")
+
+// ErrDuplicate is returned when sending a message with a [Message.DedupKey] that is already in the queue.
+var ErrDuplicate = errors.New("duplicate")
+
+// ErrReceiveTimeout is returned from [Queue.ReceiveAndWait] when the context deadline is exceeded before a message
+// could be received.
+var ErrReceiveTimeout = errors.New("receive timeout")
+
+// ValidationError is returned when [NewOpts.Validate] rejects a message, and wraps the error it returned.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
 }
 
 type ID string
@@ -77,11 +374,31 @@ type Message struct {
 	ID    ID
 	Delay time.Duration
 	Body  []byte
+
+	// DedupKey is optional. At most one message with a given key can be in the queue at a time,
+	// or within the dedup window if set. See [NewOpts.DedupWindow].
+	DedupKey string
+
+	// Producer is set on received messages, from [NewOpts.Producer] of the queue that sent it. It is ignored when sending.
+	Producer string
+
+	// Received is set on received messages to how many times the message has been received, including this time.
+	// It is ignored when sending.
+	Received int
+
+	// Timeout is set on received messages to when the message becomes receivable again, unless it is deleted or
+	// extended before that. It is ignored when sending. In PUT requests to the handler of the http package,
+	// it is the absolute time to extend the message timeout to, see [Queue.ExtendUntil].
+	Timeout time.Time
+
+	// Created is set on messages returned from [Queue.SendReturning], as stored in the database.
+	// It is ignored when sending.
+	Created time.Time
 }
 
 // Send a Message to the queue with an optional delay.
 func (q *Queue) Send(ctx context.Context, m Message) error {
-	return internalsql.InTx(q.db, func(tx *sql.Tx) error {
+	return q.inTx("send", func(tx *sql.Tx) error {
 		return q.SendTx(ctx, tx, m)
 	})
 }
@@ -92,11 +409,41 @@ func (q *Queue) SendTx(ctx context.Context, tx *sql.Tx, m Message) error {
 	return err
 }
 
+// SendBatch sends the Messages to the queue in a single transaction, in the given order.
+// Each message has its own [Message.Delay], so a batch can schedule messages for different times.
+// If any message cannot be sent, none of them are.
+func (q *Queue) SendBatch(ctx context.Context, ms []Message) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	return q.inTx("sendBatch", func(tx *sql.Tx) error {
+		return q.SendBatchTx(ctx, tx, ms)
+	})
+}
+
+// SendBatchTx is like SendBatch, but within an existing transaction.
+func (q *Queue) SendBatchTx(ctx context.Context, tx *sql.Tx, ms []Message) error {
+	// Check all delays before sending anything, so a bad batch doesn't leave partial inserts in the transaction
+	for _, m := range ms {
+		if m.Delay < 0 {
+			panic("delay cannot be negative")
+		}
+	}
+
+	for _, m := range ms {
+		if err := q.SendTx(ctx, tx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SendAndGetID is like Send, but also returns the message ID, which can be used
 // to interact with the message without receiving it first.
 func (q *Queue) SendAndGetID(ctx context.Context, m Message) (ID, error) {
 	var id ID
-	err := internalsql.InTx(q.db, func(tx *sql.Tx) error {
+	err := q.inTx("sendAndGetID", func(tx *sql.Tx) error {
 		var err error
 		id, err = q.SendAndGetIDTx(ctx, tx, m)
 		return err
@@ -106,119 +453,2292 @@ func (q *Queue) SendAndGetID(ctx context.Context, m Message) (ID, error) {
 
 // SendAndGetIDTx is like SendAndGetID, but within an existing transaction.
 func (q *Queue) SendAndGetIDTx(ctx context.Context, tx *sql.Tx, m Message) (ID, error) {
-	if m.Delay < 0 {
-		panic("delay cannot be negative")
-	}
-
-	timeout := time.Now().Add(m.Delay).Format(rfc3339Milli)
+	id, _, err := q.SendAndGetMetaTx(ctx, tx, m)
+	return id, err
+}
 
+// SendAndGetMeta is like SendAndGetID, but also returns the created timestamp of the message, as stored in the database.
+func (q *Queue) SendAndGetMeta(ctx context.Context, m Message) (ID, time.Time, error) {
 	var id ID
-	query := `insert into goqite (queue, body, timeout) values (?, ?, ?) returning id`
-	if err := tx.QueryRowContext(ctx, query, q.name, m.Body, timeout).Scan(&id); err != nil {
-		return "", err
+	var created time.Time
+	err := q.inTx("sendAndGetMeta", func(tx *sql.Tx) error {
+		var err error
+		id, created, err = q.SendAndGetMetaTx(ctx, tx, m)
+		return err
+	})
+	return id, created, err
+}
+
+// SendAndGetMetaTx is like SendAndGetMeta, but within an existing transaction.
+func (q *Queue) SendAndGetMetaTx(ctx context.Context, tx *sql.Tx, m Message) (ID, time.Time, error) {
+	sent, err := q.sendTx(ctx, tx, m)
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	return id, nil
+	return sent.ID, sent.Created, nil
 }
 
-// Receive a Message from the queue, or nil if there is none.
-func (q *Queue) Receive(ctx context.Context) (*Message, error) {
-	var m *Message
-	err := internalsql.InTx(q.db, func(tx *sql.Tx) error {
+// SendReturning is like SendAndGetID, but returns the whole message as stored in the database, with its ID,
+// [Message.Created], and [Message.Timeout] set, for example to return it to an API caller without querying it.
+// If the message is a body duplicate, see [NewOpts.DedupBody], the existing message is returned.
+func (q *Queue) SendReturning(ctx context.Context, m Message) (Message, error) {
+	var sent Message
+	err := q.inTx("sendReturning", func(tx *sql.Tx) error {
 		var err error
-		m, err = q.ReceiveTx(ctx, tx)
+		sent, err = q.SendReturningTx(ctx, tx, m)
 		return err
 	})
-	return m, err
+	return sent, err
 }
 
-// ReceiveTx is like Receive, but within an existing transaction.
-func (q *Queue) ReceiveTx(ctx context.Context, tx *sql.Tx) (*Message, error) {
-	now := time.Now()
-	nowFormatted := now.Format(rfc3339Milli)
-	timeoutFormatted := now.Add(q.timeout).Format(rfc3339Milli)
+// SendReturningTx is like SendReturning, but within an existing transaction.
+func (q *Queue) SendReturningTx(ctx context.Context, tx *sql.Tx, m Message) (Message, error) {
+	return q.sendTx(ctx, tx, m)
+}
+
+// sendTx sends the message and returns it with the ID, created, and timeout values from the database.
+func (q *Queue) sendTx(ctx context.Context, tx *sql.Tx, m Message) (Message, error) {
+	if m.Delay < 0 {
+		panic("delay cannot be negative")
+	}
+
+	if q.validate != nil {
+		if err := q.validate(m); err != nil {
+			return Message{}, &ValidationError{Err: err}
+		}
+	}
+
+	if err := q.expireDedupKey(ctx, tx, m); err != nil {
+		return Message{}, q.wrapErr("send", err)
+	}
+
+	hash := q.bodyHash(m)
+	if hash != nil {
+		dup, err := q.findBodyDuplicate(ctx, tx, *hash)
+		if err != nil {
+			return Message{}, q.wrapErr("send", err)
+		}
+		if dup != nil {
+			return *dup, nil
+		}
+	}
+
+	if err := q.checkDepth(ctx, tx, "send"); err != nil {
+		return Message{}, err
+	}
+
+	timeout := time.Now().Add(m.Delay).Format(rfc3339Milli)
 
 	query := `
-		update goqite
-		set
-			timeout = ?,
-			received = received + 1
-		where id = (
-			select id from goqite
-			where
-				queue = ? and
-				? >= timeout and
-				received < ?
-			order by created
-			limit 1
-		)
-		returning id, body`
+		insert into goqite (queue, body, timeout, dedup_key, producer, body_hash, checksum) values (?, ?, ?, ?, ?, ?, ?)
+		on conflict (queue, dedup_key) where dedup_key is not null do nothing
+		returning id, created, timeout`
+	args := []any{q.name, m.Body, timeout, dedupKey(m), q.producer, hash, q.checksum(m)}
 
-	var m Message
-	if err := tx.QueryRowContext(ctx, query, timeoutFormatted, q.name, nowFormatted, q.maxReceive).Scan(&m.ID, &m.Body); err != nil {
+	if q.idFunc != nil || q.idPrefix != "" {
+		query = `
+			insert into goqite (id, queue, body, timeout, dedup_key, producer, body_hash, checksum) values (?, ?, ?, ?, ?, ?, ?, ?)
+			on conflict (queue, dedup_key) where dedup_key is not null do nothing
+			returning id, created, timeout`
+		args = append([]any{q.newID()}, args...)
+	}
+
+	var created string
+	if err := q.queryRow(ctx, tx, query, args, &m.ID, &created, &timeout); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return Message{}, ErrDuplicate
 		}
-		return nil, err
+		return Message{}, q.wrapErr("send", err)
 	}
-	return &m, nil
+
+	var err error
+	if m.Created, err = time.Parse(rfc3339Milli, created); err != nil {
+		return Message{}, err
+	}
+	if m.Timeout, err = time.Parse(rfc3339Milli, timeout); err != nil {
+		return Message{}, err
+	}
+	m.Producer = q.producer
+	return m, nil
 }
 
-// ReceiveAndWait for a Message from the queue, polling at the given interval, until the context is cancelled.
-// If the context is cancelled, the error will be non-nil. See [context.Context.Err].
-func (q *Queue) ReceiveAndWait(ctx context.Context, interval time.Duration) (*Message, error) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// SendAfter sends a message with the given body, which can be received after the given delay.
+func (q *Queue) SendAfter(ctx context.Context, body []byte, delay time.Duration) (ID, error) {
+	return q.SendAndGetID(ctx, Message{Body: body, Delay: delay})
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-ticker.C:
-			m, err := q.Receive(ctx)
-			if err != nil {
-				return nil, err
-			}
-			if m != nil {
-				return m, nil
-			}
-		}
+// SendAt sends a message with the given body, which can be received at the given time.
+// The time must be in the future.
+func (q *Queue) SendAt(ctx context.Context, body []byte, t time.Time) (ID, error) {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return "", errors.New("send time must be in the future")
 	}
+	return q.SendAndGetID(ctx, Message{Body: body, Delay: delay})
 }
 
-// Extend a Message timeout by the given delay from now.
-func (q *Queue) Extend(ctx context.Context, id ID, delay time.Duration) error {
-	return internalsql.InTx(q.db, func(tx *sql.Tx) error {
-		return q.ExtendTx(ctx, tx, id, delay)
+// SendIdempotent is like SendAndGetID, but if a message with the same [Message.DedupKey] is already in the queue,
+// the ID of the existing message is returned instead of [ErrDuplicate].
+// The returned bool is true if the message was newly created.
+// This makes it safe to retry sending the same logical message.
+func (q *Queue) SendIdempotent(ctx context.Context, m Message) (ID, bool, error) {
+	var id ID
+	var created bool
+	err := q.inTx("sendIdempotent", func(tx *sql.Tx) error {
+		var err error
+		id, created, err = q.SendIdempotentTx(ctx, tx, m)
+		return err
 	})
+	return id, created, err
 }
 
-// ExtendTx is like Extend, but within an existing transaction.
-func (q *Queue) ExtendTx(ctx context.Context, tx *sql.Tx, id ID, delay time.Duration) error {
-	if delay < 0 {
+// SendIdempotentTx is like SendIdempotent, but within an existing transaction.
+func (q *Queue) SendIdempotentTx(ctx context.Context, tx *sql.Tx, m Message) (ID, bool, error) {
+	if m.DedupKey == "" {
+		panic("dedup key cannot be empty")
+	}
+
+	if m.Delay < 0 {
 		panic("delay cannot be negative")
 	}
 
-	timeout := time.Now().Add(delay).Format(rfc3339Milli)
+	if q.validate != nil {
+		if err := q.validate(m); err != nil {
+			return "", false, &ValidationError{Err: err}
+		}
+	}
+
+	if err := q.expireDedupKey(ctx, tx, m); err != nil {
+		return "", false, q.wrapErr("send", err)
+	}
+
+	// Look for an existing message first, so a retried send of a message that is already in a full queue succeeds
+	var id ID
+	err := q.queryRow(ctx, tx, `select id from goqite where queue = ? and dedup_key = ?`, []any{q.name, m.DedupKey}, &id)
+	if err == nil {
+		return id, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", false, q.wrapErr("send", err)
+	}
+
+	// Like in sendTx, a body duplicate is returned instead of sending the message again, see NewOpts.DedupBody
+	hash := q.bodyHash(m)
+	if hash != nil {
+		dup, err := q.findBodyDuplicate(ctx, tx, *hash)
+		if err != nil {
+			return "", false, q.wrapErr("send", err)
+		}
+		if dup != nil {
+			return dup.ID, false, nil
+		}
+	}
+
+	if err := q.checkDepth(ctx, tx, "send"); err != nil {
+		return "", false, err
+	}
+
+	timeout := time.Now().Add(m.Delay).Format(rfc3339Milli)
+
+	// Generate the ID here, so we can tell whether the returned ID belongs to a new or an existing message
+	newID := q.newID()
+
+	query := `
+		insert into goqite (id, queue, body, timeout, dedup_key, producer, body_hash, checksum) values (?, ?, ?, ?, ?, ?, ?, ?)
+		on conflict (queue, dedup_key) where dedup_key is not null do update set dedup_key = excluded.dedup_key
+		returning id`
+	args := []any{newID, q.name, m.Body, timeout, m.DedupKey, q.producer, hash, q.checksum(m)}
+	if err := q.queryRow(ctx, tx, query, args, &id); err != nil {
+		return "", false, q.wrapErr("send", err)
+	}
+	return id, id == newID, nil
+}
+
+// checkDepth returns [ErrQueueFull] if the queue has reached its max depth, and wraps database errors for the operation op.
+// It must run in the same transaction as the insert, so concurrent sends can't both pass the check.
+func (q *Queue) checkDepth(ctx context.Context, tx *sql.Tx, op string) error {
+	if q.maxDepth == 0 {
+		return nil
+	}
+
+	var n int
+	query := `select coalesce((select length from goqite_lengths where queue = ?), 0)`
+	if err := q.queryRow(ctx, tx, query, []any{q.name}, &n); err != nil {
+		return q.wrapErr(op, err)
+	}
+	if n >= q.maxDepth {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// newID from the ID func if set, or in the same format as the schema default otherwise, with the ID prefix if set.
+func (q *Queue) newID() ID {
+	if q.idFunc != nil {
+		return q.idFunc()
+	}
 
-	_, err := tx.ExecContext(ctx, `update goqite set timeout = ? where queue = ? and id = ?`, timeout, q.name, id)
+	prefix := "m_"
+	if q.idPrefix != "" {
+		prefix = q.idPrefix
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return ID(prefix + hex.EncodeToString(b))
+}
+
+// expireDedupKey clears the dedup key of an existing message with the same key as m, if it was created before the
+// dedup window, so a new message with the key can be sent.
+func (q *Queue) expireDedupKey(ctx context.Context, tx *sql.Tx, m Message) error {
+	if q.dedupWindow == 0 || m.DedupKey == "" {
+		return nil
+	}
+
+	created := time.Now().UTC().Add(-q.dedupWindow).Format(rfc3339Milli)
+
+	query := `update goqite set dedup_key = null where queue = ? and dedup_key = ? and created < ?`
+	_, err := q.exec(ctx, tx, query, q.name, m.DedupKey, created)
 	return err
 }
 
-// Delete a Message from the queue by id.
-func (q *Queue) Delete(ctx context.Context, id ID) error {
-	return internalsql.InTx(q.db, func(tx *sql.Tx) error {
-		return q.DeleteTx(ctx, tx, id)
+// bodyHash is the hex-encoded SHA-256 hash of the message body if body deduplication is enabled, or nil otherwise,
+// so it's stored as null.
+func (q *Queue) bodyHash(m Message) *string {
+	if !q.dedupBody {
+		return nil
+	}
+	sum := sha256.Sum256(m.Body)
+	hash := hex.EncodeToString(sum[:])
+	return &hash
+}
+
+// checksum of the message body for [NewOpts.VerifyChecksum], or nil if not enabled.
+func (q *Queue) checksum(m Message) *int64 {
+	if !q.verifyChecksum {
+		return nil
+	}
+	sum := int64(crc32.ChecksumIEEE(m.Body))
+	return &sum
+}
+
+// verifyTx the body of the received message m against its stored checksum, if any, and returns [ErrCorrupt] if it
+// doesn't match, after moving the message to the corrupt queue if set.
+func (q *Queue) verifyTx(ctx context.Context, tx *sql.Tx, m *Message, checksum *int64) error {
+	if !q.verifyChecksum || checksum == nil || *checksum == int64(crc32.ChecksumIEEE(m.Body)) {
+		return nil
+	}
+
+	if q.corruptQueue != "" {
+		if err := q.ArchiveTx(ctx, tx, m.ID, q.corruptQueue); err != nil {
+			return q.wrapErr("receive", err)
+		}
+	}
+	return fmt.Errorf("message %v: %w", m.ID, ErrCorrupt)
+}
+
+// inReceiveTx is like inTx, but also commits the transaction if cb returns [ErrCorrupt], so the receive of a corrupt
+// message counts, and it's not received again right away. The error is still returned.
+func (q *Queue) inReceiveTx(op string, cb func(tx *sql.Tx) error) error {
+	var corruptErr error
+	err := q.inTx(op, func(tx *sql.Tx) error {
+		err := cb(tx)
+		if errors.Is(err, ErrCorrupt) {
+			corruptErr = err
+			return nil
+		}
+		return err
 	})
+	if err != nil {
+		return err
+	}
+	return corruptErr
 }
 
-// DeleteTx is like Delete, but within an existing transaction.
-func (q *Queue) DeleteTx(ctx context.Context, tx *sql.Tx, id ID) error {
-	_, err := tx.ExecContext(ctx, `delete from goqite where queue = ? and id = ?`, q.name, id)
-	return err
+// findBodyDuplicate returns the newest message in the queue with the given body hash, sent within the dedup body window,
+// or nil if there is none.
+func (q *Queue) findBodyDuplicate(ctx context.Context, tx *sql.Tx, hash string) (*Message, error) {
+	var after string
+	if q.dedupBodyWindow > 0 {
+		after = time.Now().UTC().Add(-q.dedupBodyWindow).Format(rfc3339Milli)
+	}
+
+	var m Message
+	var created, timeout string
+	query := `
+		select id, body, dedup_key, producer, created, timeout from goqite
+		where queue = ? and body_hash = ? and created >= ? and deleted is null
+		order by created desc
+		limit 1`
+	var dedupKey *string
+	args := []any{q.name, hash, after}
+	if err := q.queryRow(ctx, tx, query, args, &m.ID, &m.Body, &dedupKey, &m.Producer, &created, &timeout); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if dedupKey != nil {
+		m.DedupKey = *dedupKey
+	}
+
+	var err error
+	if m.Created, err = time.Parse(rfc3339Milli, created); err != nil {
+		return nil, err
+	}
+	if m.Timeout, err = time.Parse(rfc3339Milli, timeout); err != nil {
+		return nil, err
+	}
+	return &m, nil
 }
 
-// Setup the queue in the database.
-func Setup(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, schema)
+// dedupKey for the message, or nil if it doesn't have one, so it's stored as null.
+func dedupKey(m Message) *string {
+	if m.DedupKey == "" {
+		return nil
+	}
+	return &m.DedupKey
+}
+
+// Outbox runs fn in a new transaction and sends the Message it returns within the same transaction.
+// This is useful for the transactional outbox pattern, where domain changes and the message should be committed
+// together. If fn returns an error, the transaction is rolled back and nothing is sent.
+// Note that fn is called again if the transaction is retried because the database is busy. See [NewOpts.BusyRetries].
+func (q *Queue) Outbox(ctx context.Context, fn func(tx *sql.Tx) (Message, error)) (ID, error) {
+	var id ID
+	err := q.inTx("outbox", func(tx *sql.Tx) error {
+		m, err := fn(tx)
+		if err != nil {
+			return err
+		}
+		id, err = q.SendAndGetIDTx(ctx, tx, m)
+		return err
+	})
+	return id, err
+}
+
+// ReceiveOption is an option for [Queue.Receive], [Queue.ReceiveMany], and their Tx variants,
+// to change how messages are received.
+type ReceiveOption func(*receiveOpts)
+
+type receiveOpts struct {
+	filter     string
+	filterArgs []any
+	max        int
+	timeout    time.Duration
+}
+
+// WithMax is the max number of messages to receive with [Queue.ReceiveMany], which is one by default.
+// Receive panics if given a max larger than one, because it receives a single message.
+func WithMax(n int) ReceiveOption {
+	if n <= 0 {
+		panic("max must be larger than zero")
+	}
+
+	return func(o *receiveOpts) {
+		o.max = n
+	}
+}
+
+// WithVisibilityTimeout overrides the queue timeout from [NewOpts.Timeout] for the received message.
+// The redelivery jitter from [NewOpts.RedeliveryJitter] is still added.
+func WithVisibilityTimeout(d time.Duration) ReceiveOption {
+	if d <= 0 {
+		panic("visibility timeout must be larger than zero")
+	}
+
+	return func(o *receiveOpts) {
+		o.timeout = d
+	}
+}
+
+// WithFilter is an SQL boolean expression on goqite table columns that the received message must match,
+// in addition to [NewOpts.ReceiveFilter]. Like there, always use placeholders and args for values.
+// Giving the option more than once requires the message to match all filters.
+func WithFilter(filter string, args ...any) ReceiveOption {
+	if filter == "" {
+		panic("filter cannot be empty")
+	}
+
+	return func(o *receiveOpts) {
+		if o.filter != "" {
+			o.filter += ` and `
+		}
+		o.filter += `(` + filter + `)`
+		o.filterArgs = append(o.filterArgs, args...)
+	}
+}
+
+// Receive a Message from the queue, or nil if there is none.
+// Without options, the queue's own settings are used. See [ReceiveOption].
+func (q *Queue) Receive(ctx context.Context, opts ...ReceiveOption) (*Message, error) {
+	var m *Message
+	err := q.inReceiveTx("receive", func(tx *sql.Tx) error {
+		var err error
+		m, err = q.ReceiveTx(ctx, tx, opts...)
+		return err
+	})
+	return m, err
+}
+
+// ReceiveHandle is like Receive, but also returns ack and nack functions bound to the received message.
+// Call ack to delete the message after processing it, or nack to make it receivable again right away after failing to.
+// See [Queue.Delete] and [Queue.Nack]. If there is no message, the message and both functions are nil.
+func (q *Queue) ReceiveHandle(ctx context.Context) (*Message, func(context.Context) error, func(context.Context) error, error) {
+	m, err := q.Receive(ctx)
+	if err != nil || m == nil {
+		return nil, nil, nil, err
+	}
+
+	ack := func(ctx context.Context) error {
+		return q.Delete(ctx, m.ID)
+	}
+	nack := func(ctx context.Context) error {
+		return q.Nack(ctx, m.ID)
+	}
+	return m, ack, nack, nil
+}
+
+// ReceiveFromFirst tries to receive a Message from each of the queues in order, and returns the first message found,
+// together with the queue it came from, so the message can be extended or deleted in the right queue.
+// Use it to prioritize queues, so later queues are only received from when earlier ones are empty.
+// Returns nil and a nil queue if there is no message in any of the queues.
+func ReceiveFromFirst(ctx context.Context, queues []*Queue) (*Message, *Queue, error) {
+	for _, q := range queues {
+		m, err := q.Receive(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m != nil {
+			return m, q, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// ReceiveN returns an iterator that receives up to n messages, one at a time, as they are consumed.
+// Each message is received in its own transaction, just before it is yielded, so breaking out of the loop early
+// doesn't claim any more messages. Iteration stops early if the queue is empty, and after yielding an error.
+// With Go 1.23 or later, use it in a range loop:
+//
+//	for m, err := range q.ReceiveN(ctx, 10) {
+//		...
+//	}
+func (q *Queue) ReceiveN(ctx context.Context, n int) func(yield func(*Message, error) bool) {
+	if n < 0 {
+		panic("n cannot be negative")
+	}
+
+	return func(yield func(*Message, error) bool) {
+		for i := 0; i < n; i++ {
+			m, err := q.Receive(ctx)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if m == nil {
+				return
+			}
+			if !yield(m, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ReceiveTx is like Receive, but within an existing transaction.
+// If it returns [ErrCorrupt], commit the transaction anyway, so the receive of the corrupt message counts.
+func (q *Queue) ReceiveTx(ctx context.Context, tx *sql.Tx, opts ...ReceiveOption) (*Message, error) {
+	var o receiveOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.max > 1 {
+		panic("max cannot be larger than one, use ReceiveMany to receive more messages")
+	}
+
+	return q.receiveTx(ctx, tx, o)
+}
+
+// ReceiveMany receives up to the max number of messages given with [WithMax] in a single transaction,
+// in the same order as [Queue.Receive] would, or an empty slice if there are none.
+// The other options apply to every message. Messages failing the checksum check are left out,
+// see [NewOpts.VerifyChecksum].
+func (q *Queue) ReceiveMany(ctx context.Context, opts ...ReceiveOption) ([]*Message, error) {
+	var ms []*Message
+	err := q.inTx("receiveMany", func(tx *sql.Tx) error {
+		var err error
+		ms, err = q.ReceiveManyTx(ctx, tx, opts...)
+		return err
+	})
+	return ms, err
+}
+
+// ReceiveManyTx is like ReceiveMany, but within an existing transaction.
+func (q *Queue) ReceiveManyTx(ctx context.Context, tx *sql.Tx, opts ...ReceiveOption) ([]*Message, error) {
+	o := receiveOpts{max: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ms := []*Message{}
+	for i := 0; i < o.max; i++ {
+		m, err := q.receiveTx(ctx, tx, o)
+		if errors.Is(err, ErrCorrupt) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			break
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func (q *Queue) receiveTx(ctx context.Context, tx *sql.Tx, o receiveOpts) (*Message, error) {
+	var m Message
+	var timeout string
+	var checksum *int64
+	if err := q.claimTx(ctx, tx, o, "id, body, producer, received, timeout, checksum",
+		&m.ID, &m.Body, &m.Producer, &m.Received, &timeout, &checksum); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, q.wrapErr("receive", err)
+	}
+
+	if err := q.verifyTx(ctx, tx, &m, checksum); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if m.Timeout, err = time.Parse(rfc3339Milli, timeout); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ReceiveID receives the Message with the given id, regardless of its position in the queue.
+// It is claimed like with [Queue.Receive], so it is not received by others until it times out.
+// Returns nil if the message is in flight, delayed, or has been received the maximum number of times,
+// and [ErrNotFound] if there is no message with the given id in the queue.
+func (q *Queue) ReceiveID(ctx context.Context, id ID) (*Message, error) {
+	var m *Message
+	err := q.inReceiveTx("receiveID", func(tx *sql.Tx) error {
+		var err error
+		m, err = q.ReceiveIDTx(ctx, tx, id)
+		return err
+	})
+	return m, err
+}
+
+// ReceiveIDTx is like ReceiveID, but within an existing transaction.
+func (q *Queue) ReceiveIDTx(ctx context.Context, tx *sql.Tx, id ID) (*Message, error) {
+	now := time.Now()
+
+	query := `
+		update goqite
+		set
+			timeout = ?,
+			received = received + 1,
+			heartbeat = null
+		where id = ? and queue = ? and deleted is null and ? >= timeout and received < ?
+		returning id, body, producer, received, timeout, checksum`
+
+	var m Message
+	var timeout string
+	var checksum *int64
+	timeoutFormatted := now.Add(q.receiveTimeout(0)).Format(rfc3339Milli)
+	args := []any{timeoutFormatted, id, q.name, now.Format(rfc3339Milli), q.MaxReceive()}
+	err := q.queryRow(ctx, tx, query, args, &m.ID, &m.Body, &m.Producer, &m.Received, &timeout, &checksum)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, q.wrapErr("receive", err)
+		}
+
+		var exists bool
+		query = `select exists (select 1 from goqite where id = ? and queue = ? and deleted is null)`
+		if err := q.queryRow(ctx, tx, query, []any{id, q.name}, &exists); err != nil {
+			return nil, q.wrapErr("receive", err)
+		}
+		if !exists {
+			return nil, ErrNotFound
+		}
+		return nil, nil
+	}
+
+	if err := q.verifyTx(ctx, tx, &m, checksum); err != nil {
+		return nil, err
+	}
+
+	if m.Timeout, err = time.Parse(rfc3339Milli, timeout); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// dbtx is a *sql.DB or *sql.Tx.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// exec the query on db, calling the query hook if set.
+func (q *Queue) exec(ctx context.Context, db dbtx, query string, args ...any) (sql.Result, error) {
+	start := time.Now()
+	var res sql.Result
+	var err error
+	if s, done := q.stmt(ctx, db, query); s != nil {
+		res, err = s.ExecContext(ctx, args...)
+		done()
+	} else {
+		res, err = db.ExecContext(ctx, query, args...)
+	}
+	if q.queryHook != nil {
+		q.queryHook(query, args, time.Since(start), err)
+	}
+	return res, err
+}
+
+// query on db, calling the query hook if set.
+// The query is not run as a cached prepared statement, because the statement would have to stay open with the rows.
+func (q *Queue) query(ctx context.Context, db dbtx, query string, args ...any) (*sql.Rows, error) {
+	if q.queryHook == nil {
+		return db.QueryContext(ctx, query, args...)
+	}
+
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, query, args...)
+	q.queryHook(query, args, time.Since(start), err)
+	return rows, err
+}
+
+// queryRow on db and scan it into dest, calling the query hook if set.
+func (q *Queue) queryRow(ctx context.Context, db dbtx, query string, args []any, dest ...any) error {
+	start := time.Now()
+	var err error
+	if s, done := q.stmt(ctx, db, query); s != nil {
+		err = s.QueryRowContext(ctx, args...).Scan(dest...)
+		done()
+	} else {
+		err = db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	}
+	if q.queryHook != nil {
+		q.queryHook(query, args, time.Since(start), err)
+	}
+	return err
+}
+
+// stmt returns the cached prepared statement for the query bound to db, and a function to call when done with it.
+// It returns a nil statement if the statement isn't cached (yet), or if db is not one of the queue's own transactions:
+// transactions passed to the Tx methods may be on another database handle, which statements prepared on the queue
+// database can't be used with. Outside of a transaction, cached statements aren't used, so the use lock below is never
+// held while waiting for a free connection.
+func (q *Queue) stmt(ctx context.Context, db dbtx, query string) (*sql.Stmt, func()) {
+	tx, ok := db.(*sql.Tx)
+	if !ok || !q.stmts.owns(tx) {
+		return nil, nil
+	}
+
+	// Hold the use lock while the statement is in use, so Close doesn't close it in the meantime
+	q.stmts.use.RLock()
+	s := q.stmts.get(query)
+	if s == nil {
+		q.stmts.use.RUnlock()
+		return nil, nil
+	}
+
+	// Closing the statement bound to the transaction is cheaper than keeping it open until the transaction ends.
+	// It doesn't close the cached statement.
+	s = tx.StmtContext(ctx, s)
+	return s, func() {
+		_ = s.Close()
+		q.stmts.use.RUnlock()
+	}
+}
+
+// Close the prepared statements cached by the queue, after waiting for the ones in use. The queue can still be used
+// afterwards, but doesn't cache prepared statements anymore. Close doesn't close the database.
+func (q *Queue) Close() error {
+	return q.stmts.close()
+}
+
+// maxCachedStmts is the max number of prepared statements cached per queue. Queries with varying SQL,
+// like batch sends with a varying number of messages, would otherwise grow the cache without bounds.
+const maxCachedStmts = 100
+
+// stmtCache of prepared statements by query, so queries don't have to be parsed on every call.
+//
+// Statements are prepared on the database connection pool, which can't be done while a transaction holds the only
+// connection, as is common with SQLite. So queries not in the cache are run unprepared and marked as pending,
+// and pending queries are prepared before the queue starts its next transaction. Cached statements are bound to
+// the queue's own transactions with [sql.Tx.StmtContext].
+type stmtCache struct {
+	closed  bool
+	mu      sync.Mutex
+	pending map[string]struct{}
+	stmts   map[string]*sql.Stmt
+	txs     map[*sql.Tx]struct{} // The queue's own transactions, see Queue.inTx
+	use     sync.RWMutex         // Read locked while a statement is in use, write locked while closing
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{
+		pending: map[string]struct{}{},
+		stmts:   map[string]*sql.Stmt{},
+		txs:     map[*sql.Tx]struct{}{},
+	}
+}
+
+// own marks tx as one of the queue's own transactions, which cached statements can be bound to, until disown.
+func (c *stmtCache) own(tx *sql.Tx) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.txs[tx] = struct{}{}
+}
+
+func (c *stmtCache) disown(tx *sql.Tx) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.txs, tx)
+}
+
+func (c *stmtCache) owns(tx *sql.Tx) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.txs[tx]
+	return ok
+}
+
+// get the statement for the query, or mark the query as pending and return nil if it's not cached.
+func (c *stmtCache) get(query string) *sql.Stmt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	if s, ok := c.stmts[query]; ok {
+		return s
+	}
+
+	if len(c.stmts)+len(c.pending) < maxCachedStmts {
+		c.pending[query] = struct{}{}
+	}
+	return nil
+}
+
+// prepare pending queries on db. The lock is not held while preparing, because preparing waits for a free connection,
+// which may be held by a transaction that needs the lock in get.
+func (c *stmtCache) prepare(db *sql.DB) {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	var queries []string
+	for query := range c.pending {
+		queries = append(queries, query)
+	}
+	c.pending = map[string]struct{}{}
+	c.mu.Unlock()
+
+	for _, query := range queries {
+		// Errors are ignored, because the query is just run unprepared and returns the error then
+		s, err := db.Prepare(query)
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if _, ok := c.stmts[query]; ok || c.closed {
+			_ = s.Close()
+		} else {
+			c.stmts[query] = s
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *stmtCache) close() error {
+	c.use.Lock()
+	defer c.use.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+
+	var errs []error
+	for query, s := range c.stmts {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(c.stmts, query)
+	}
+	c.pending = map[string]struct{}{}
+	return errors.Join(errs...)
+}
+
+// receiveTimeout is the timeout for a received message, with a random redelivery jitter if set.
+// A zero timeout means the queue timeout.
+func (q *Queue) receiveTimeout(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		timeout = q.timeout
+	}
+	if q.jitter == 0 {
+		return timeout
+	}
+	return timeout + time.Duration(mathrand.Int63n(int64(q.jitter)))
+}
+
+// claimTx claims the next receivable message by setting its timeout and incrementing its received count,
+// and scans the given returning columns into dest. Returns [sql.ErrNoRows] if there is no message.
+func (q *Queue) claimTx(ctx context.Context, tx *sql.Tx, o receiveOpts, columns string, dest ...any) error {
+	now := time.Now()
+	nowFormatted := now.Format(rfc3339Milli)
+	timeoutFormatted := now.Add(q.receiveTimeout(o.timeout)).Format(rfc3339Milli)
+
+	selectQuery := `
+			select id from goqite
+			where
+				queue = ? and
+				deleted is null and
+				received < ?`
+
+	selectArgs := []any{q.name, q.MaxReceive()}
+
+	// In strict FIFO mode, the visibility check is on the oldest message only, instead of finding the oldest visible one,
+	// so an in-flight or delayed head of the queue blocks all later messages.
+	if !q.strictFIFO {
+		selectQuery += ` and ? >= timeout`
+		selectArgs = append(selectArgs, nowFormatted)
+	}
+
+	if q.filter != "" {
+		selectQuery += ` and (` + q.filter + `)`
+		selectArgs = append(selectArgs, q.filterArgs...)
+	}
+
+	if o.filter != "" {
+		selectQuery += ` and ` + o.filter
+		selectArgs = append(selectArgs, o.filterArgs...)
+	}
+
+	// Messages with the same created timestamp, for example from a batch send, are ordered by rowid, which increases
+	// on insert, so the order is deterministic and the same as the insertion order.
+	selectQuery += `
+			order by created, rowid
+			limit 1`
+
+	if q.singleConsumer {
+		return q.claimByIDTx(ctx, tx, selectQuery, selectArgs, nowFormatted, timeoutFormatted, columns, dest...)
+	}
+
+	query := `
+		update goqite
+		set
+			timeout = ?,
+			received = received + 1,
+			heartbeat = null
+		where id = (` + selectQuery + `
+		)`
+
+	args := append([]any{timeoutFormatted}, selectArgs...)
+
+	if q.strictFIFO {
+		query += ` and ? >= timeout`
+		args = append(args, nowFormatted)
+	}
+
+	query += `
+		returning ` + columns
+
+	return q.queryRow(ctx, tx, query, args, dest...)
+}
+
+// claimByIDTx is the receive path for [NewOpts.SingleConsumer], which selects the ID of the next message with
+// selectQuery and then claims it by ID. The claim checks again that the message can be received, so it's still correct
+// with concurrent consumers, in which case it returns [sql.ErrNoRows] if another consumer claimed the message first.
+func (q *Queue) claimByIDTx(ctx context.Context, tx *sql.Tx, selectQuery string, selectArgs []any, nowFormatted,
+	timeoutFormatted string, columns string, dest ...any) error {
+	var id ID
+	if err := q.queryRow(ctx, tx, selectQuery, selectArgs, &id); err != nil {
+		return err
+	}
+
+	query := `
+		update goqite
+		set
+			timeout = ?,
+			received = received + 1,
+			heartbeat = null
+		where
+			id = ? and
+			queue = ? and
+			deleted is null and
+			received < ? and
+			? >= timeout
+		returning ` + columns
+
+	return q.queryRow(ctx, tx, query, []any{timeoutFormatted, id, q.name, q.MaxReceive(), nowFormatted}, dest...)
+}
+
+// MessageHeader is the metadata of a message received with [Queue.ReceiveStream].
+type MessageHeader struct {
+	ID       ID
+	Received int // How many times the message has been received, including this time.
+	Size     int // Size of the body in bytes.
+}
+
+// bodyChunkSize is how many bytes of a message body are read from the database at a time when streaming.
+const bodyChunkSize = 64 * 1024
+
+// ReceiveStream is like Receive, but returns the message header and a reader for the body instead of the whole
+// message. The body is read from the database in chunks as the reader is read, so large bodies are not held in memory
+// all at once. Returns nils if there is no message.
+// The reader returns [ErrNotFound] if the message is deleted while reading.
+//
+// This is not incremental blob I/O, because that is not available through database/sql. Each chunk is read with its
+// own query, and SQLite reads the whole body for each of them, so the database I/O grows with the square of the body
+// size. It saves memory in the caller, not work in the database.
+//
+// With [NewOpts.VerifyChecksum], the body is verified when the reader reaches the end of it, which returns
+// [ErrCorrupt] instead of [io.EOF] if it doesn't match, after moving the message to the corrupt queue if set.
+func (q *Queue) ReceiveStream(ctx context.Context) (*MessageHeader, io.ReadCloser, error) {
+	var h MessageHeader
+	var checksum *int64
+	err := q.inTx("receiveStream", func(tx *sql.Tx) error {
+		return q.claimTx(ctx, tx, receiveOpts{}, "id, received, length(body), checksum", &h.ID, &h.Received, &h.Size,
+			&checksum)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	return &h, &bodyReader{checksum: checksum, ctx: ctx, q: q, id: h.ID, size: h.Size}, nil
+}
+
+// bodyReader reads a message body from the database in chunks.
+type bodyReader struct {
+	buf      []byte
+	checksum *int64
+	closed   bool
+	crc      uint32
+	ctx      context.Context
+	id       ID
+	offset   int
+	q        *Queue
+	size     int
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+
+	if len(r.buf) == 0 {
+		if r.offset >= r.size {
+			return 0, r.verify()
+		}
+
+		// substr is 1-indexed
+		query := `select substr(body, ?, ?) from goqite where queue = ? and id = ? and deleted is null`
+		err := r.q.queryRow(r.ctx, r.q.db, query, []any{r.offset + 1, bodyChunkSize, r.q.name, r.id}, &r.buf)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, ErrNotFound
+			}
+			return 0, err
+		}
+		if len(r.buf) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.offset += len(r.buf)
+		r.crc = crc32.Update(r.crc, crc32.IEEETable, r.buf)
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// verify the checksum of the whole body, like [Queue.verifyTx], and return [io.EOF] if it matches.
+func (r *bodyReader) verify() error {
+	if !r.q.verifyChecksum || r.checksum == nil || *r.checksum == int64(r.crc) {
+		return io.EOF
+	}
+
+	if r.q.corruptQueue != "" {
+		if err := r.q.Archive(r.ctx, r.id, r.q.corruptQueue); err != nil {
+			return r.q.wrapErr("receive", err)
+		}
+	}
+	return fmt.Errorf("message %v: %w", r.id, ErrCorrupt)
+}
+
+func (r *bodyReader) Close() error {
+	r.buf = nil
+	r.closed = true
+	return nil
+}
+
+// ReceiveAndDelete receives a Message from the queue and deletes it in the same transaction, or returns nil if
+// there is none.
+// This gives at-most-once delivery: if processing the message fails, it is not redelivered.
+func (q *Queue) ReceiveAndDelete(ctx context.Context) (*Message, error) {
+	var m *Message
+	err := q.inReceiveTx("receiveAndDelete", func(tx *sql.Tx) error {
+		var err error
+		m, err = q.ReceiveAndDeleteTx(ctx, tx)
+		return err
+	})
+	return m, err
+}
+
+// ReceiveAndDeleteTx is like ReceiveAndDelete, but within an existing transaction.
+func (q *Queue) ReceiveAndDeleteTx(ctx context.Context, tx *sql.Tx) (*Message, error) {
+	m, err := q.ReceiveTx(ctx, tx)
+	if err != nil || m == nil {
+		return m, err
+	}
+	if err := q.DeleteTx(ctx, tx, m.ID); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReceiveAndWait for a Message from the queue, polling at the given interval, until the context is cancelled.
+// If the context is cancelled, the error will be non-nil. See [context.Context.Err].
+// If the context deadline is exceeded, the error is [ErrReceiveTimeout], which also unwraps to
+// [context.DeadlineExceeded], so waiting on an empty queue can be told apart from cancellation.
+func (q *Queue) ReceiveAndWait(ctx context.Context, interval time.Duration) (*Message, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, receiveAndWaitErr(ctx)
+		case <-ticker.C:
+			m, err := q.Receive(ctx)
+			if err != nil {
+				// The context may have been cancelled during the receive
+				if ctx.Err() != nil {
+					return nil, receiveAndWaitErr(ctx)
+				}
+				return nil, err
+			}
+			if m != nil {
+				return m, nil
+			}
+		}
+	}
+}
+
+// ReceiveBatchWithWait receives up to n Messages from the queue, polling at the given interval, until it has n messages
+// or maxWait has passed, whichever comes first. It returns the messages received so far, which may be none.
+// Use it to trade off batch size against latency.
+// If the context is cancelled, the error is non-nil, and the messages received so far are returned with it,
+// so they can still be processed or released.
+func (q *Queue) ReceiveBatchWithWait(ctx context.Context, n int, maxWait, interval time.Duration) ([]*Message, error) {
+	if n <= 0 {
+		panic("n must be larger than zero")
+	}
+
+	if maxWait < 0 {
+		panic("max wait cannot be negative")
+	}
+
+	if interval <= 0 {
+		panic("interval must be larger than zero")
+	}
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var ms []*Message
+	for {
+		for len(ms) < n {
+			m, err := q.Receive(ctx)
+			if err != nil {
+				return ms, err
+			}
+			if m == nil {
+				break
+			}
+			ms = append(ms, m)
+		}
+
+		if len(ms) == n {
+			return ms, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ms, ctx.Err()
+		case <-timer.C:
+			return ms, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stream messages from the queue on the returned channel, polling at the given interval, until the context is
+// cancelled, after which the channel is closed.
+// The channel is unbuffered, so a slow consumer is not sent more messages than it can handle.
+// Receive errors are retried at the given interval.
+// As with Receive, the caller is responsible for deleting or extending the messages.
+func (q *Queue) Stream(ctx context.Context, interval time.Duration) <-chan *Message {
+	ms := make(chan *Message)
+
+	go func() {
+		defer close(ms)
+
+		for {
+			m, err := q.ReceiveAndWait(ctx, interval)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+					continue
+				}
+			}
+
+			// If the context is cancelled here, the received message is redelivered after its timeout
+			select {
+			case <-ctx.Done():
+				return
+			case ms <- m:
+			}
+		}
+	}()
+
+	return ms
+}
+
+func receiveAndWaitErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrReceiveTimeout, ctx.Err())
+	}
+	return ctx.Err()
+}
+
+// Extend a Message timeout by the given delay from now.
+func (q *Queue) Extend(ctx context.Context, id ID, delay time.Duration) error {
+	return q.inTx("extend", func(tx *sql.Tx) error {
+		return q.ExtendTx(ctx, tx, id, delay)
+	})
+}
+
+// ExtendTx is like Extend, but within an existing transaction.
+func (q *Queue) ExtendTx(ctx context.Context, tx *sql.Tx, id ID, delay time.Duration) error {
+	if delay < 0 {
+		panic("delay cannot be negative")
+	}
+
+	return q.extendTx(ctx, tx, id, time.Now().Add(delay))
+}
+
+// ExtendUntil sets a Message timeout to the given absolute time, which must be in the future.
+// Unlike repeated calls to Extend, this does not accumulate drift.
+func (q *Queue) ExtendUntil(ctx context.Context, id ID, t time.Time) error {
+	return q.inTx("extendUntil", func(tx *sql.Tx) error {
+		return q.ExtendUntilTx(ctx, tx, id, t)
+	})
+}
+
+// ExtendUntilTx is like ExtendUntil, but within an existing transaction.
+func (q *Queue) ExtendUntilTx(ctx context.Context, tx *sql.Tx, id ID, t time.Time) error {
+	if !t.After(time.Now()) {
+		return errors.New("timeout must be in the future")
+	}
+
+	return q.extendTx(ctx, tx, id, t)
+}
+
+func (q *Queue) extendTx(ctx context.Context, tx *sql.Tx, id ID, t time.Time) error {
+	// Timeouts are compared as strings, so they must be in the same zone as the ones from time.Now elsewhere
+	timeout := t.In(time.Local).Format(rfc3339Milli)
+
+	_, err := q.exec(ctx, tx, `update goqite set timeout = ? where queue = ? and id = ? and deleted is null`, timeout, q.name, id)
+	return q.wrapErr("extend", err)
+}
+
+// ExtendBatch extends the timeout of all Messages with the given ids by delay, in a single statement.
+// It returns the number of messages actually extended, so ids that were already deleted or never existed can be detected.
+func (q *Queue) ExtendBatch(ctx context.Context, ids []ID, delay time.Duration) (int, error) {
+	var n int
+	err := q.inTx("extendBatch", func(tx *sql.Tx) error {
+		var err error
+		n, err = q.ExtendBatchTx(ctx, tx, ids, delay)
+		return err
+	})
+	return n, err
+}
+
+// ExtendBatchTx is like ExtendBatch, but within an existing transaction.
+func (q *Queue) ExtendBatchTx(ctx context.Context, tx *sql.Tx, ids []ID, delay time.Duration) (int, error) {
+	if delay < 0 {
+		panic("delay cannot be negative")
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	timeout := time.Now().Add(delay).Format(rfc3339Milli)
+
+	args := []any{timeout, q.name}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	query := `update goqite set timeout = ? where queue = ? and deleted is null and id in (` + placeholders + `)`
+	res, err := q.exec(ctx, tx, query, args...)
+	if err != nil {
+		return 0, q.wrapErr("extend", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), q.wrapErr("extend", err)
+}
+
+// Delete a Message from the queue by id.
+func (q *Queue) Delete(ctx context.Context, id ID) error {
+	return q.inTx("delete", func(tx *sql.Tx) error {
+		return q.DeleteTx(ctx, tx, id)
+	})
+}
+
+// DeleteTx is like Delete, but within an existing transaction.
+func (q *Queue) DeleteTx(ctx context.Context, tx *sql.Tx, id ID) error {
+	if q.tombstone {
+		// Clear the dedup key, so it can be reused right away like with a real delete
+		query := `update goqite set deleted = ?, dedup_key = null where queue = ? and id = ? and deleted is null`
+		_, err := q.exec(ctx, tx, query, time.Now().Format(rfc3339Milli), q.name, id)
+		return q.wrapErr("delete", err)
+	}
+
+	_, err := q.exec(ctx, tx, `delete from goqite where queue = ? and id = ?`, q.name, id)
+	return q.wrapErr("delete", err)
+}
+
+// Archive a processed Message by moving it to the queue named archiveQueue, instead of deleting it.
+// The archived message gets a fresh created timestamp and a timeout in the far future, so it is never received from the
+// archive queue. Its dedup key is cleared, so it can be reused in the live queue.
+// Returns [ErrNotFound] if there is no message with the given id in the queue.
+func (q *Queue) Archive(ctx context.Context, id ID, archiveQueue string) error {
+	return q.inTx("archive", func(tx *sql.Tx) error {
+		return q.ArchiveTx(ctx, tx, id, archiveQueue)
+	})
+}
+
+// ArchiveTx is like Archive, but within an existing transaction.
+func (q *Queue) ArchiveTx(ctx context.Context, tx *sql.Tx, id ID, archiveQueue string) error {
+	if archiveQueue == "" {
+		panic("archive queue cannot be empty")
+	}
+
+	if archiveQueue == q.name {
+		panic("archive queue cannot be the same as the queue")
+	}
+
+	query := `
+		update goqite
+		set
+			queue = ?,
+			created = ?,
+			timeout = '9999-12-31T23:59:59.999Z',
+			dedup_key = null
+		where queue = ? and id = ? and deleted is null`
+	res, err := q.exec(ctx, tx, query, archiveQueue, time.Now().UTC().Format(rfc3339Milli), q.name, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Compact removes messages that were deleted more than retention ago with [NewOpts.Tombstone], and returns how many.
+// Run it periodically, for example from a job.
+func (q *Queue) Compact(ctx context.Context, retention time.Duration) (int, error) {
+	var n int
+	err := q.inTx("compact", func(tx *sql.Tx) error {
+		var err error
+		n, err = q.CompactTx(ctx, tx, retention)
+		return err
+	})
+	return n, err
+}
+
+// CompactTx is like Compact, but within an existing transaction.
+func (q *Queue) CompactTx(ctx context.Context, tx *sql.Tx, retention time.Duration) (int, error) {
+	if retention < 0 {
+		panic("retention cannot be negative")
+	}
+
+	deleted := time.Now().Add(-retention).Format(rfc3339Milli)
+
+	res, err := q.exec(ctx, tx, `delete from goqite where queue = ? and deleted is not null and deleted <= ?`, q.name, deleted)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Ack a Message after processing it, which deletes it from the queue. It's an alias for [Queue.Delete].
+func (q *Queue) Ack(ctx context.Context, id ID) error {
+	return q.Delete(ctx, id)
+}
+
+// AckTx is like Ack, but within an existing transaction.
+func (q *Queue) AckTx(ctx context.Context, tx *sql.Tx, id ID) error {
+	return q.DeleteTx(ctx, tx, id)
+}
+
+// Heartbeat signals that the consumer of the received Message with the given id is still alive, and will send another
+// heartbeat within interval. If it doesn't, [Queue.ReapExpiredLeases] releases the message, so a crashed consumer
+// is detected faster than with the message timeout alone. The first heartbeat registers the message for reaping.
+// Returns [ErrNotFound] if there is no message with the given id in the queue.
+func (q *Queue) Heartbeat(ctx context.Context, id ID, interval time.Duration) error {
+	return q.inTx("heartbeat", func(tx *sql.Tx) error {
+		return q.HeartbeatTx(ctx, tx, id, interval)
+	})
+}
+
+// HeartbeatTx is like Heartbeat, but within an existing transaction.
+func (q *Queue) HeartbeatTx(ctx context.Context, tx *sql.Tx, id ID, interval time.Duration) error {
+	if interval <= 0 {
+		panic("interval must be larger than zero")
+	}
+
+	heartbeat := time.Now().Add(interval).Format(rfc3339Milli)
+
+	query := `update goqite set heartbeat = ? where queue = ? and id = ? and deleted is null`
+	res, err := q.exec(ctx, tx, query, heartbeat, q.name, id)
+	if err != nil {
+		return q.wrapErr("heartbeat", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Touch the Message with the given id, setting its updated timestamp to now without changing its timeout or received
+// count, for example to record when external tooling last looked at it.
+// Returns [ErrNotFound] if there is no message with the given id in the queue.
+func (q *Queue) Touch(ctx context.Context, id ID) error {
+	return q.inTx("touch", func(tx *sql.Tx) error {
+		return q.TouchTx(ctx, tx, id)
+	})
+}
+
+// TouchTx is like Touch, but within an existing transaction.
+func (q *Queue) TouchTx(ctx context.Context, tx *sql.Tx, id ID) error {
+	query := `update goqite set updated = strftime('%Y-%m-%dT%H:%M:%fZ') where queue = ? and id = ? and deleted is null`
+	res, err := q.exec(ctx, tx, query, q.name, id)
+	if err != nil {
+		return q.wrapErr("touch", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReapExpiredLeases makes in-flight messages whose consumer has missed its [Queue.Heartbeat] immediately receivable
+// again, regardless of their timeout. Messages without heartbeats are not affected. Returns how many messages were
+// released. Run it periodically, at least as often as the heartbeat interval.
+func (q *Queue) ReapExpiredLeases(ctx context.Context) (int, error) {
+	var n int
+	err := q.inTx("reapExpiredLeases", func(tx *sql.Tx) error {
+		var err error
+		n, err = q.ReapExpiredLeasesTx(ctx, tx)
+		return err
+	})
+	return n, err
+}
+
+// ReapExpiredLeasesTx is like ReapExpiredLeases, but within an existing transaction.
+func (q *Queue) ReapExpiredLeasesTx(ctx context.Context, tx *sql.Tx) (int, error) {
+	now := time.Now().Format(rfc3339Milli)
+
+	query := `
+		update goqite
+		set
+			timeout = ?,
+			heartbeat = null
+		where queue = ? and heartbeat is not null and ? > heartbeat and timeout > ? and deleted is null`
+	res, err := q.exec(ctx, tx, query, now, q.name, now, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Nack a Message after failing to process it, which makes it immediately receivable again,
+// instead of waiting for its timeout. The received count is not reset, so it still counts towards the max receive
+// count.
+func (q *Queue) Nack(ctx context.Context, id ID) error {
+	return q.inTx("nack", func(tx *sql.Tx) error {
+		return q.NackTx(ctx, tx, id)
+	})
+}
+
+// NackTx is like Nack, but within an existing transaction.
+func (q *Queue) NackTx(ctx context.Context, tx *sql.Tx, id ID) error {
+	return q.extendTx(ctx, tx, id, time.Now())
+}
+
+// ResetReceived makes a Message immediately receivable again, with its received count reset to zero.
+// Returns [ErrNotFound] if there is no message with the given id in the queue.
+func (q *Queue) ResetReceived(ctx context.Context, id ID) error {
+	return q.inTx("resetReceived", func(tx *sql.Tx) error {
+		return q.ResetReceivedTx(ctx, tx, id)
+	})
+}
+
+// ResetReceivedTx is like ResetReceived, but within an existing transaction.
+func (q *Queue) ResetReceivedTx(ctx context.Context, tx *sql.Tx, id ID) error {
+	timeout := time.Now().Format(rfc3339Milli)
+
+	query := `update goqite set received = 0, timeout = ? where queue = ? and id = ? and deleted is null`
+	res, err := q.exec(ctx, tx, query, timeout, q.name, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RetryExhausted makes all messages in the queue that have reached the max receive count immediately receivable
+// again, with their received counts reset to zero. Returns how many messages were reset.
+func (q *Queue) RetryExhausted(ctx context.Context) (int, error) {
+	var n int
+	err := q.inTx("retryExhausted", func(tx *sql.Tx) error {
+		var err error
+		n, err = q.RetryExhaustedTx(ctx, tx)
+		return err
+	})
+	return n, err
+}
+
+// RetryExhaustedTx is like RetryExhausted, but within an existing transaction.
+func (q *Queue) RetryExhaustedTx(ctx context.Context, tx *sql.Tx) (int, error) {
+	timeout := time.Now().Format(rfc3339Milli)
+
+	query := `update goqite set received = 0, timeout = ? where queue = ? and received >= ? and deleted is null`
+	res, err := q.exec(ctx, tx, query, timeout, q.name, q.MaxReceive())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// ReplayDeadLetters moves up to limit messages from this queue, used as a dead-letter queue, back to the queue named
+// sourceQueue, oldest first. Replayed messages are immediately receivable, with their received counts reset to zero.
+// Returns how many messages were replayed.
+// Messages can be moved to a dead-letter queue with [Queue.Archive].
+func (q *Queue) ReplayDeadLetters(ctx context.Context, sourceQueue string, limit int) (int, error) {
+	var n int
+	err := q.inTx("replayDeadLetters", func(tx *sql.Tx) error {
+		var err error
+		n, err = q.ReplayDeadLettersTx(ctx, tx, sourceQueue, limit)
+		return err
+	})
+	return n, err
+}
+
+// ReplayDeadLettersTx is like ReplayDeadLetters, but within an existing transaction.
+func (q *Queue) ReplayDeadLettersTx(ctx context.Context, tx *sql.Tx, sourceQueue string, limit int) (int, error) {
+	return q.replayDeadLettersTx(ctx, tx, sourceQueue, limit, 0)
+}
+
+// ReplayDeadLettersWithRate is like ReplayDeadLetters, but instead of making the replayed messages receivable all at
+// once, it spreads them out at rate messages per second, oldest first, so consumers are not overwhelmed.
+func (q *Queue) ReplayDeadLettersWithRate(ctx context.Context, sourceQueue string, limit int, rate float64) (int, error) {
+	var n int
+	err := q.inTx("replayDeadLettersWithRate", func(tx *sql.Tx) error {
+		var err error
+		n, err = q.ReplayDeadLettersWithRateTx(ctx, tx, sourceQueue, limit, rate)
+		return err
+	})
+	return n, err
+}
+
+// ReplayDeadLettersWithRateTx is like ReplayDeadLettersWithRate, but within an existing transaction.
+func (q *Queue) ReplayDeadLettersWithRateTx(ctx context.Context, tx *sql.Tx, sourceQueue string, limit int,
+	rate float64) (int, error) {
+	if rate <= 0 {
+		panic("rate must be larger than zero")
+	}
+
+	return q.replayDeadLettersTx(ctx, tx, sourceQueue, limit, rate)
+}
+
+// replayDeadLettersTx replays dead letters all at once if rate is zero, or spread out at rate messages per second.
+func (q *Queue) replayDeadLettersTx(ctx context.Context, tx *sql.Tx, sourceQueue string, limit int,
+	rate float64) (int, error) {
+	if sourceQueue == "" {
+		panic("source queue cannot be empty")
+	}
+
+	if sourceQueue == q.name {
+		panic("source queue cannot be the same as the queue")
+	}
+
+	if limit <= 0 {
+		panic("limit must be larger than zero")
+	}
+
+	now := time.Now()
+
+	if rate == 0 {
+		query := `
+			update goqite
+			set
+				queue = ?,
+				received = 0,
+				timeout = ?
+			where id in (
+				select id from goqite
+				where queue = ? and deleted is null
+				order by created, rowid
+				limit ?
+			)`
+		res, err := q.exec(ctx, tx, query, sourceQueue, now.Format(rfc3339Milli), q.name, limit)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}
+
+	query := `select id from goqite where queue = ? and deleted is null order by created, rowid limit ?`
+	rows, err := q.query(ctx, tx, query, q.name, limit)
+	if err != nil {
+		return 0, err
+	}
+	var ids []ID
+	for rows.Next() {
+		var id ID
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Each message becomes receivable 1/rate seconds after the previous one
+	interval := float64(time.Second) / rate
+	query = `update goqite set queue = ?, received = 0, timeout = ? where queue = ? and id = ?`
+	for i, id := range ids {
+		timeout := now.Add(time.Duration(float64(i) * interval)).Format(rfc3339Milli)
+		if _, err := q.exec(ctx, tx, query, sourceQueue, timeout, q.name, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// ApproxLen returns the number of messages in the queue in constant time, by reading a count maintained by triggers
+// on the goqite table. Like a full count, it includes messages that are delayed, in flight, or have reached the max
+// receive count. It is only approximate in the sense that it can drift if the table is changed with triggers
+// disabled, or if the schema was not created with [Setup] or schema.sql.
+func (q *Queue) ApproxLen(ctx context.Context) (int, error) {
+	var n int
+	query := `select coalesce((select length from goqite_lengths where queue = ?), 0)`
+	if err := q.queryRow(ctx, q.db, query, []any{q.name}, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Vacuum the database to reclaim the space left by deleted messages, which SQLite doesn't do by itself.
+// Note that it vacuums the whole database, not just this queue, and that it needs temporary disk space of up to twice
+// the database size while running. It can't run inside a transaction, so there's no VacuumTx.
+// To reclaim space continuously instead, enable incremental auto vacuum with "pragma auto_vacuum = incremental",
+// followed by a one-time Vacuum, and run "pragma incremental_vacuum" periodically.
+func (q *Queue) Vacuum(ctx context.Context) error {
+	_, err := q.exec(ctx, q.db, `vacuum`)
+	return err
+}
+
+// Depths returns the number of messages in each queue in the database, in a single query, by queue name.
+// If visibleOnly is true, only messages that are not delayed or in flight are counted, which includes messages that
+// have reached the max receive count, since that is a per-queue setting. Queues without messages are not included.
+func Depths(ctx context.Context, db *sql.DB, visibleOnly bool) (map[string]int, error) {
+	query := `select queue, count(*) from goqite where deleted is null group by queue`
+	var args []any
+	if visibleOnly {
+		query = `select queue, count(*) from goqite where deleted is null and ? >= timeout group by queue`
+		args = append(args, time.Now().Format(rfc3339Milli))
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	depths := map[string]int{}
+	for rows.Next() {
+		var queue string
+		var n int
+		if err := rows.Scan(&queue, &n); err != nil {
+			return nil, err
+		}
+		depths[queue] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return depths, nil
+}
+
+// Stats about the messages in a queue, from [Queue.Stats].
+type Stats struct {
+	Messages       int     // Number of messages in the queue.
+	TotalBodyBytes int     // Sum of the body sizes of all messages in the queue.
+	MaxBodyBytes   int     // Size of the largest message body in the queue.
+	AvgBodyBytes   float64 // Average message body size in the queue.
+}
+
+// Stats returns statistics about the messages in the queue, including message body sizes, to spot oversized messages.
+// Like [Queue.ApproxLen], it includes messages that are delayed, in flight, or have reached the max receive count.
+// It reads all messages in the queue, so it is slower than ApproxLen on big queues.
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	query := `
+		select count(*), coalesce(sum(length(body)), 0), coalesce(max(length(body)), 0) from goqite
+		where queue = ? and deleted is null`
+	err := q.queryRow(ctx, q.db, query, []any{q.name}, &stats.Messages, &stats.TotalBodyBytes, &stats.MaxBodyBytes)
+	if err != nil {
+		return Stats{}, err
+	}
+	if stats.Messages > 0 {
+		stats.AvgBodyBytes = float64(stats.TotalBodyBytes) / float64(stats.Messages)
+	}
+	return stats, nil
+}
+
+// Drain blocks until the queue is empty, checking [Queue.ApproxLen] every interval, or until the context is done,
+// in which case the context error is returned. Use it to wait for consumers to process everything, in tests
+// or at shutdown. Note that messages that are delayed, in flight, or have reached the max receive count
+// all count as being in the queue, so it only drains once they have been deleted.
+func (q *Queue) Drain(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		panic("interval must be larger than zero")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := q.ApproxLen(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// OldestVisibleAge returns how long the oldest receivable message that has never been received has been waiting in the
+// queue, or zero if there is none. Use it to detect a growing backlog.
+func (q *Queue) OldestVisibleAge(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+
+	var created sql.NullString
+	query := `select min(created) from goqite where queue = ? and ? >= timeout and received = 0 and deleted is null`
+	if err := q.queryRow(ctx, q.db, query, []any{q.name, now.Format(rfc3339Milli)}, &created); err != nil {
+		return 0, err
+	}
+	if !created.Valid {
+		return 0, nil
+	}
+
+	t, err := time.Parse(rfc3339Milli, created.String)
+	if err != nil {
+		return 0, err
+	}
+	return max(now.Sub(t), 0), nil
+}
+
+// ListOpts are options for [Queue.ListMessages].
+//   - [ListOpts.Cursor] is the cursor returned from a previous call, or empty for the first page.
+//   - [ListOpts.Limit] is the page size, which defaults to 100.
+type ListOpts struct {
+	Cursor string
+	Limit  int
+}
+
+// Sample returns up to n receivable messages in the queue, in the order they would be received, without receiving them.
+// Unlike [Queue.Receive], the messages' received counts and timeouts are not changed, so sampling doesn't use up
+// any receives. Use it for monitoring, for example of message sizes.
+func (q *Queue) Sample(ctx context.Context, n int) ([]Message, error) {
+	if n < 0 {
+		panic("n cannot be negative")
+	}
+
+	query := `
+		select id, body, producer, received, timeout from goqite
+		where queue = ? and ? >= timeout and received < ? and deleted is null
+		order by created, rowid
+		limit ?`
+
+	rows, err := q.query(ctx, q.db, query, q.name, time.Now().Format(rfc3339Milli), q.MaxReceive(), n)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var ms []Message
+	for rows.Next() {
+		var m Message
+		var timeout string
+		if err := rows.Scan(&m.ID, &m.Body, &m.Producer, &m.Received, &timeout); err != nil {
+			return nil, err
+		}
+		if m.Timeout, err = time.Parse(rfc3339Milli, timeout); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// InFlight returns the messages in the queue that are currently being processed, meaning they have been received and
+// their timeout has not passed yet, ordered by timeout. [Message.Timeout] is when each message becomes receivable
+// again, so time.Until(m.Timeout) is the remaining time of its lease. Use it to find stuck or slow consumers.
+// It is read-only and does not affect message visibility.
+func (q *Queue) InFlight(ctx context.Context) ([]Message, error) {
+	query := `
+		select id, body, producer, received, timeout from goqite
+		where queue = ? and received > 0 and timeout > ? and deleted is null
+		order by timeout, id`
+
+	rows, err := q.query(ctx, q.db, query, q.name, time.Now().Format(rfc3339Milli))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var ms []Message
+	for rows.Next() {
+		var m Message
+		var timeout string
+		if err := rows.Scan(&m.ID, &m.Body, &m.Producer, &m.Received, &timeout); err != nil {
+			return nil, err
+		}
+		if m.Timeout, err = time.Parse(rfc3339Milli, timeout); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// ListMessages in the queue, ordered by creation time, a page at a time.
+// Returns the messages and the cursor for the next page, which is empty if there are no more messages.
+// Listing is read-only and does not affect message visibility.
+func (q *Queue) ListMessages(ctx context.Context, opts ListOpts) ([]Message, string, error) {
+	if opts.Limit < 0 {
+		panic("limit cannot be negative")
+	}
+
+	if opts.Limit == 0 {
+		opts.Limit = 100
+	}
+
+	var created string
+	var id ID
+	if opts.Cursor != "" {
+		var err error
+		created, id, err = decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	query := `
+		select id, created, body from goqite
+		where
+			queue = ? and
+			deleted is null and
+			(created, id) > (?, ?)
+		order by created, id
+		limit ?`
+
+	rows, err := q.query(ctx, q.db, query, q.name, created, id, opts.Limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var ms []Message
+	var cursor string
+	for rows.Next() {
+		if len(ms) == opts.Limit {
+			cursor = encodeCursor(created, id)
+			break
+		}
+		var m Message
+		if err := rows.Scan(&m.ID, &created, &m.Body); err != nil {
+			return nil, "", err
+		}
+		id = m.ID
+		ms = append(ms, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return ms, cursor, nil
+}
+
+func encodeCursor(created string, id ID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(created + " " + string(id)))
+}
+
+func decodeCursor(cursor string) (string, ID, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", errors.New("invalid cursor")
+	}
+	created, id, ok := strings.Cut(string(b), " ")
+	if !ok {
+		return "", "", errors.New("invalid cursor")
+	}
+	return created, ID(id), nil
+}
+
+// exportedMessage is a message in the [Queue.Export] format.
+type exportedMessage struct {
+	ID       ID     `json:"id"`
+	Created  string `json:"created"`
+	Delay    string `json:"delay,omitempty"`
+	Body     []byte `json:"body"`
+	DedupKey string `json:"dedup_key,omitempty"`
+	Producer string `json:"producer,omitempty"`
+	Received int    `json:"received,omitempty"`
+}
+
+// Export all messages in the queue to w, as JSON lines, in the order they would be received.
+// Each line has the message id, created timestamp, remaining delay as a duration string, body as base64,
+// and the dedup key, producer, and received count if set. The messages are read in a single transaction,
+// so the export is a consistent snapshot. Import the messages into another queue with [Queue.Import].
+func (q *Queue) Export(ctx context.Context, w io.Writer) error {
+	return q.inTx("export", func(tx *sql.Tx) error {
+		query := `
+			select id, created, timeout, body, coalesce(dedup_key, ''), producer, received from goqite
+			where queue = ? and deleted is null
+			order by created, rowid`
+		rows, err := q.query(ctx, tx, query, q.name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		now := time.Now()
+		enc := json.NewEncoder(w)
+		for rows.Next() {
+			var em exportedMessage
+			var timeout string
+			if err := rows.Scan(&em.ID, &em.Created, &timeout, &em.Body, &em.DedupKey, &em.Producer, &em.Received); err != nil {
+				return err
+			}
+			t, err := time.Parse(rfc3339Milli, timeout)
+			if err != nil {
+				return err
+			}
+			if delay := t.Sub(now); delay > 0 {
+				em.Delay = delay.String()
+			}
+			if err := enc.Encode(em); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// Import messages exported with [Queue.Export] from r into the queue, in a single transaction, and returns how many
+// were imported. The message ids, created timestamps, dedup keys, producers, and received counts are kept,
+// and the remaining delays start from now. If any message cannot be imported, for example because a message with
+// the same id already exists, none are. Like with sends, messages are checked with [NewOpts.Validate]
+// and against [NewOpts.MaxDepth].
+func (q *Queue) Import(ctx context.Context, r io.Reader) (int, error) {
+	var n int
+	err := q.inTx("import", func(tx *sql.Tx) error {
+		dec := json.NewDecoder(r)
+		for {
+			var em exportedMessage
+			if err := dec.Decode(&em); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return fmt.Errorf("error decoding message %v: %w", n+1, err)
+			}
+
+			if em.ID == "" {
+				return fmt.Errorf("message %v has no id", n+1)
+			}
+
+			if _, err := time.Parse(rfc3339Milli, em.Created); err != nil {
+				return fmt.Errorf("error parsing created of message %v: %w", em.ID, err)
+			}
+
+			var delay time.Duration
+			if em.Delay != "" {
+				var err error
+				if delay, err = time.ParseDuration(em.Delay); err != nil {
+					return fmt.Errorf("error parsing delay of message %v: %w", em.ID, err)
+				}
+			}
+
+			if em.Body == nil {
+				em.Body = []byte{}
+			}
+
+			m := Message{ID: em.ID, Delay: delay, Body: em.Body, DedupKey: em.DedupKey, Producer: em.Producer,
+				Received: em.Received}
+			if q.validate != nil {
+				if err := q.validate(m); err != nil {
+					return fmt.Errorf("message %v: %w", em.ID, &ValidationError{Err: err})
+				}
+			}
+
+			if err := q.checkDepth(ctx, tx, "import"); err != nil {
+				return fmt.Errorf("message %v: %w", em.ID, err)
+			}
+
+			query := `
+				insert into goqite (id, created, queue, body, timeout, received, dedup_key, producer, body_hash, checksum)
+				values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			timeout := time.Now().Add(delay).Format(rfc3339Milli)
+			_, err := q.exec(ctx, tx, query, em.ID, em.Created, q.name, em.Body, timeout, em.Received, dedupKey(m),
+				em.Producer, q.bodyHash(m), q.checksum(m))
+			if err != nil {
+				return q.wrapErr("import", err)
+			}
+			n++
+		}
+	})
+	if err != nil {
+		// Database errors are already wrapped, but decoding, validation, and depth errors are not
+		var qErr *QueueError
+		if !errors.As(err, &qErr) {
+			err = q.wrapErr("import", err)
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// inTx runs cb in a transaction for the operation op, retrying if the database is busy.
+// The operation is logged with the queue name if cb panics.
+func (q *Queue) inTx(op string, cb func(tx *sql.Tx) error) error {
+	q.stmts.prepare(q.db)
+	opts := q.txOpts
+	opts.Name = q.name
+	opts.Op = op
+	return internalsql.InTxWithOpts(q.db, opts, func(tx *sql.Tx) error {
+		q.stmts.own(tx)
+		defer q.stmts.disown(tx)
+		return cb(tx)
+	})
+}
+
+// migrations upgrade an existing schema, starting from the first version of schema.sql.
+// Migration i upgrades the schema from version i+1 to version i+2.
+// Migrations must be idempotent, because the schema may have been created from a newer schema.sql than the
+// version recorded in the database.
+var migrations = []func(ctx context.Context, tx *sql.Tx) error{
+	// Version 2 adds message deduplication keys.
+	func(ctx context.Context, tx *sql.Tx) error {
+		if err := addColumn(ctx, tx, "dedup_key", "text"); err != nil {
+			return err
+		}
+		query := `create unique index if not exists goqite_queue_dedup_key_idx on goqite (queue, dedup_key) where dedup_key is not null`
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	},
+
+	// Version 3 adds message counts per queue, maintained by triggers.
+	func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			create table if not exists goqite_lengths (
+				queue text primary key,
+				length integer not null default 0
+			) strict;
+
+			create trigger if not exists goqite_lengths_insert after insert on goqite begin
+				insert into goqite_lengths (queue, length) values (new.queue, 1)
+				on conflict (queue) do update set length = length + 1;
+			end;
+
+			create trigger if not exists goqite_lengths_delete after delete on goqite begin
+				update goqite_lengths set length = length - 1 where queue = old.queue;
+			end;
+
+			create trigger if not exists goqite_lengths_update after update of queue on goqite when old.queue != new.queue begin
+				update goqite_lengths set length = length - 1 where queue = old.queue;
+				insert into goqite_lengths (queue, length) values (new.queue, 1)
+				on conflict (queue) do update set length = length + 1;
+			end;
+
+			insert into goqite_lengths (queue, length) select queue, count(*) from goqite where true group by queue
+			on conflict (queue) do update set length = excluded.length;`
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	},
+
+	// Version 4 adds the message producer.
+	func(ctx context.Context, tx *sql.Tx) error {
+		return addColumn(ctx, tx, "producer", "text not null default ''")
+	},
+
+	// Version 5 adds tombstones for deleted messages, which don't count towards the queue length.
+	// The lengths are counted again, because version 3 counts tombstones when the schema was created from a newer
+	// schema.sql without a recorded version.
+	func(ctx context.Context, tx *sql.Tx) error {
+		if err := addColumn(ctx, tx, "deleted", "text"); err != nil {
+			return err
+		}
+		query := `
+			create index if not exists goqite_queue_deleted_idx on goqite (queue, deleted) where deleted is not null;
+
+			drop trigger if exists goqite_lengths_delete;
+
+			create trigger goqite_lengths_delete after delete on goqite when old.deleted is null begin
+				update goqite_lengths set length = length - 1 where queue = old.queue;
+			end;
+
+			create trigger if not exists goqite_lengths_tombstone after update of deleted on goqite
+			when old.deleted is null and new.deleted is not null begin
+				update goqite_lengths set length = length - 1 where queue = old.queue;
+			end;
+
+			update goqite_lengths set length = (
+				select count(*) from goqite where goqite.queue = goqite_lengths.queue and deleted is null
+			);`
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	},
+
+	// Version 6 adds body hashes for body deduplication.
+	func(ctx context.Context, tx *sql.Tx) error {
+		if err := addColumn(ctx, tx, "body_hash", "text"); err != nil {
+			return err
+		}
+		query := `create index if not exists goqite_queue_body_hash_idx on goqite (queue, body_hash) where body_hash is not null`
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	},
+
+	// Version 7 adds consumer heartbeats for reaping leases of dead consumers.
+	func(ctx context.Context, tx *sql.Tx) error {
+		if err := addColumn(ctx, tx, "heartbeat", "text"); err != nil {
+			return err
+		}
+		query := `create index if not exists goqite_queue_heartbeat_idx on goqite (queue, heartbeat) where heartbeat is not null`
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	},
+
+	// Version 8 adds body checksums for corruption detection.
+	func(ctx context.Context, tx *sql.Tx) error {
+		return addColumn(ctx, tx, "checksum", "integer")
+	},
+}
+
+// addColumn to the goqite table, if it doesn't exist already.
+func addColumn(ctx context.Context, tx *sql.Tx, name, definition string) error {
+	var exists bool
+	query := `select exists (select 1 from pragma_table_info('goqite') where name = ?)`
+	if err := tx.QueryRowContext(ctx, query, name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("alter table goqite add column %v %v", name, definition))
 	return err
 }
+
+// logger matches the info level method from the slog.Logger.
+type logger interface {
+	Info(msg string, args ...any)
+}
+
+type discardLogger struct{}
+
+func (d *discardLogger) Info(msg string, args ...any) {}
+
+// autoSetup runs [Setup] if the goqite table doesn't exist.
+func autoSetup(ctx context.Context, db *sql.DB) error {
+	var exists bool
+	query := `select exists (select 1 from sqlite_master where type = 'table' and name = 'goqite')`
+	if err := db.QueryRowContext(ctx, query).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return Setup(ctx, db)
+}
+
+// NewInMemory opens a named, shared-cache in-memory SQLite database with the SQLite driver registered as driverName,
+// for example "sqlite3" for github.com/mattn/go-sqlite3 or "sqlite" for modernc.org/sqlite. It's configured like the
+// package recommends, and returned after checking the connection. Unlike with ":memory:", where every connection gets
+// its own empty database, all connections to the same name share one database, also across [sql.DB] values in the
+// same process, so queues see each other's tables. The database lives until its last connection is closed.
+// It's useful for tests. Call [Setup] or use [NewOpts.AutoSetup] to create the schema.
+// Only the standard SQLite URI filename parameters are used, and the rest is configured with pragmas,
+// so it works across drivers. The driver must support URI filenames.
+func NewInMemory(driverName, name string) (*sql.DB, error) {
+	if driverName == "" {
+		panic("driver name cannot be empty")
+	}
+
+	if name == "" {
+		panic("name cannot be empty")
+	}
+
+	db, err := sql.Open(driverName, "file:"+url.PathEscape(name)+"?mode=memory&cache=shared")
+	if err != nil {
+		return nil, err
+	}
+
+	// With a single connection that is never closed, the pragmas apply to all queries on the database
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	if _, err := db.Exec(`pragma busy_timeout = 5000; pragma foreign_keys = on`); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Setup the queue in the database.
+// If the goqite table doesn't exist, the current schema is created.
+// If it exists, it is migrated to the current schema version without data loss.
+// Applied schema versions are tracked in the goqite_migrations table, and Setup is safe to call more than once.
+func Setup(ctx context.Context, db *sql.DB) error {
+	return internalsql.InTx(db, func(tx *sql.Tx) error {
+		query := `
+			create table if not exists goqite_migrations (
+				version integer primary key,
+				applied text not null default (strftime('%Y-%m-%dT%H:%M:%fZ'))
+			) strict`
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+
+		var exists bool
+		query = `select exists (select 1 from sqlite_master where type = 'table' and name = 'goqite')`
+		if err := tx.QueryRowContext(ctx, query).Scan(&exists); err != nil {
+			return err
+		}
+
+		current := len(migrations) + 1
+
+		if !exists {
+			if _, err := tx.ExecContext(ctx, schema); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `insert into goqite_migrations (version) values (?)`, current)
+			return err
+		}
+
+		// An existing table without a recorded version was created from the first version of schema.sql
+		var version int
+		if err := tx.QueryRowContext(ctx, `select coalesce(max(version), 1) from goqite_migrations`).Scan(&version); err != nil {
+			return err
+		}
+
+		for v := version; v < current; v++ {
+			if err := migrations[v-1](ctx, tx); err != nil {
+				return fmt.Errorf("cannot migrate schema to version %v: %w", v+1, err)
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, `insert or ignore into goqite_migrations (version) values (?)`, current)
+		return err
+	})
+}
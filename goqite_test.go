@@ -1,17 +1,25 @@
 package goqite_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	_ "embed"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/maragudk/is"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 
 	"github.com/maragudk/goqite"
 )
@@ -19,6 +27,25 @@ import (
 //go:embed schema.sql
 var schema string
 
+// schemaV1 is the first version of schema.sql, used for testing migrations.
+const schemaV1 = `
+create table goqite (
+  id text primary key default ('m_' || lower(hex(randomblob(16)))),
+  created text not null default (strftime('%Y-%m-%dT%H:%M:%fZ')),
+  updated text not null default (strftime('%Y-%m-%dT%H:%M:%fZ')),
+  queue text not null,
+  body blob not null,
+  timeout text not null default (strftime('%Y-%m-%dT%H:%M:%fZ')),
+  received integer not null default 0
+) strict;
+
+create trigger goqite_updated_timestamp after update on goqite begin
+  update goqite set updated = strftime('%Y-%m-%dT%H:%M:%fZ') where id = old.id;
+end;
+
+create index goqite_queue_created_idx on goqite (queue, created);
+`
+
 func TestQueue(t *testing.T) {
 	t.Run("can send and receive and delete a message", func(t *testing.T) {
 		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
@@ -50,6 +77,84 @@ func TestQueue(t *testing.T) {
 	})
 }
 
+// fakeQueue is a [goqite.Queuer] backed by a slice.
+type fakeQueue struct {
+	ms []goqite.Message
+}
+
+func (f *fakeQueue) Send(ctx context.Context, m goqite.Message) error {
+	_, err := f.SendAndGetID(ctx, m)
+	return err
+}
+
+func (f *fakeQueue) SendAndGetID(ctx context.Context, m goqite.Message) (goqite.ID, error) {
+	m.ID = goqite.ID(fmt.Sprintf("m_%v", len(f.ms)))
+	f.ms = append(f.ms, m)
+	return m.ID, nil
+}
+
+func (f *fakeQueue) Receive(ctx context.Context, opts ...goqite.ReceiveOption) (*goqite.Message, error) {
+	if len(f.ms) == 0 {
+		return nil, nil
+	}
+	m := f.ms[0]
+	m.Received++
+	return &m, nil
+}
+
+func (f *fakeQueue) ReceiveAndWait(ctx context.Context, interval time.Duration) (*goqite.Message, error) {
+	return f.Receive(ctx)
+}
+
+func (f *fakeQueue) Extend(ctx context.Context, id goqite.ID, delay time.Duration) error {
+	return nil
+}
+
+func (f *fakeQueue) Nack(ctx context.Context, id goqite.ID) error {
+	return nil
+}
+
+func (f *fakeQueue) Delete(ctx context.Context, id goqite.ID) error {
+	for i, m := range f.ms {
+		if m.ID == id {
+			f.ms = append(f.ms[:i], f.ms[i+1:]...)
+			return nil
+		}
+	}
+	return goqite.ErrNotFound
+}
+
+func TestQueuer(t *testing.T) {
+	// process is application code that depends on the interface instead of *goqite.Queue
+	process := func(ctx context.Context, q goqite.Queuer) (string, error) {
+		m, err := q.Receive(ctx)
+		if err != nil || m == nil {
+			return "", err
+		}
+		return string(m.Body), q.Delete(ctx, m.ID)
+	}
+
+	queues := map[string]goqite.Queuer{
+		"queue": newQ(t, goqite.NewOpts{}, ":memory:"),
+		"fake":  &fakeQueue{},
+	}
+
+	for name, q := range queues {
+		t.Run("processes a message with a "+name, func(t *testing.T) {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+
+			body, err := process(context.Background(), q)
+			is.NotError(t, err)
+			is.Equal(t, "yo", body)
+
+			body, err = process(context.Background(), q)
+			is.NotError(t, err)
+			is.Equal(t, "", body)
+		})
+	}
+}
+
 func TestQueue_New(t *testing.T) {
 	t.Run("panics if db is nil", func(t *testing.T) {
 		defer func() {
@@ -78,6 +183,34 @@ func TestQueue_New(t *testing.T) {
 		goqite.New(goqite.NewOpts{DB: &sql.DB{}, Name: "test", MaxReceive: -1})
 	})
 
+	t.Run("panics if id prefix has invalid characters", func(t *testing.T) {
+		defer func() {
+			r := recover()
+			is.Equal(t, "id prefix can only contain letters, digits, underscores, and hyphens", r)
+		}()
+
+		goqite.New(goqite.NewOpts{DB: &sql.DB{}, Name: "test", IDPrefix: "job'"})
+	})
+
+	t.Run("logs a warning if max open connections is not one", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		db.SetMaxOpenConns(2)
+
+		var msgs []string
+		log := testLogger(func(msg string, args ...any) {
+			msgs = append(msgs, msg)
+		})
+
+		goqite.New(goqite.NewOpts{DB: db, Log: log, Name: "test"})
+		is.Equal(t, 1, len(msgs))
+		is.True(t, strings.Contains(msgs[0], "max open connections"))
+
+		db.SetMaxOpenConns(1)
+		msgs = nil
+		goqite.New(goqite.NewOpts{DB: db, Log: log, Name: "test"})
+		is.Equal(t, 0, len(msgs))
+	})
+
 	t.Run("panics if timeout is negative", func(t *testing.T) {
 		defer func() {
 			r := recover()
@@ -88,6 +221,196 @@ func TestQueue_New(t *testing.T) {
 	})
 }
 
+func TestQueue_SendAndGetMeta(t *testing.T) {
+	t.Run("returns the id and the stored created timestamp", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		before := time.Now().Add(-time.Millisecond)
+		id, created, err := q.SendAndGetMeta(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.True(t, id != "")
+		is.True(t, created.After(before))
+
+		var stored string
+		err = db.QueryRow(`select created from goqite where id = ?`, id).Scan(&stored)
+		is.NotError(t, err)
+		is.Equal(t, stored, created.Format("2006-01-02T15:04:05.000Z07:00"))
+	})
+
+	t.Run("returns ErrDuplicate on a duplicate dedup key", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		_, _, err := q.SendAndGetMeta(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		_, _, err = q.SendAndGetMeta(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Error(t, goqite.ErrDuplicate, err)
+	})
+}
+
+func TestQueue_SendReturning(t *testing.T) {
+	t.Run("returns the message as stored", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Producer: "test"}, ":memory:")
+
+		before := time.Now().Add(-time.Millisecond)
+		m, err := q.SendReturning(context.Background(), goqite.Message{Body: []byte("yo"), Delay: time.Minute})
+		is.NotError(t, err)
+		is.True(t, m.ID != "")
+		is.Equal(t, "yo", string(m.Body))
+		is.Equal(t, "test", m.Producer)
+		is.True(t, m.Created.After(before))
+		is.True(t, m.Created.Before(time.Now().Add(time.Millisecond)))
+		is.True(t, m.Timeout.After(m.Created.Add(time.Minute-time.Second)))
+		is.True(t, m.Timeout.Before(m.Created.Add(time.Minute+time.Second)))
+
+		received, err := q.ReceiveID(context.Background(), m.ID)
+		is.NotError(t, err)
+		is.Nil(t, received)
+	})
+
+	t.Run("returns the existing message for a body duplicate", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupBody: true}, ":memory:")
+
+		m1, err := q.SendReturning(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		m2, err := q.SendReturning(context.Background(), goqite.Message{Body: []byte("yo"), Delay: time.Minute})
+		is.NotError(t, err)
+		is.Equal(t, m1.ID, m2.ID)
+		is.True(t, m1.Created.Equal(m2.Created))
+		is.True(t, m1.Timeout.Equal(m2.Timeout))
+	})
+}
+
+func TestQueue_MaxDepth(t *testing.T) {
+	t.Run("rejects sends when the queue is full", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxDepth: 2}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.Error(t, goqite.ErrQueueFull, err)
+
+		err = q.Delete(context.Background(), id)
+		is.NotError(t, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+	})
+
+	t.Run("does not exceed the max depth with concurrent sends", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxDepth: 5}, ":memory:")
+
+		var wg sync.WaitGroup
+		var sent, full atomic.Int32
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+				switch {
+				case err == nil:
+					sent.Add(1)
+				case errors.Is(err, goqite.ErrQueueFull):
+					full.Add(1)
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		is.Equal(t, int32(5), sent.Load())
+		is.Equal(t, int32(15), full.Load())
+	})
+}
+
+func TestQueue_SendBatch(t *testing.T) {
+	t.Run("sends all messages in order", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b")}, {Body: []byte("c")}})
+		is.NotError(t, err)
+
+		for _, body := range []string{"a", "b", "c"} {
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			is.Equal(t, body, string(m.Body))
+		}
+	})
+
+	t.Run("makes each message visible after its own delay", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{
+			{Body: []byte("later"), Delay: 100 * time.Millisecond},
+			{Body: []byte("now")},
+			{Body: []byte("soon"), Delay: 50 * time.Millisecond},
+		})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "now", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(50 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "soon", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(50 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "later", string(m.Body))
+	})
+
+	t.Run("panics on a negative delay without sending any message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		func() {
+			defer func() {
+				is.Equal(t, "delay cannot be negative", recover())
+			}()
+			_ = q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b"), Delay: -1}})
+		}()
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("sends none of the messages if one fails", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{
+			{Body: []byte("a"), DedupKey: "k"},
+			{Body: []byte("b"), DedupKey: "k"},
+		})
+		is.Error(t, goqite.ErrDuplicate, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
 func TestQueue_Send(t *testing.T) {
 	t.Run("panics if delay is negative", func(t *testing.T) {
 		q := newQ(t, goqite.NewOpts{}, ":memory:")
@@ -101,201 +424,2995 @@ func TestQueue_Send(t *testing.T) {
 
 		err = q.Send(context.Background(), goqite.Message{Delay: -1})
 	})
-}
 
-func TestQueue_Receive(t *testing.T) {
-	t.Run("does not receive a delayed message immediately", func(t *testing.T) {
+	t.Run("does not send a message that fails validation", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Validate: func(m goqite.Message) error {
+			if len(m.Body) == 0 {
+				return errors.New("body cannot be empty")
+			}
+			return nil
+		}}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{})
+		is.Equal(t, "body cannot be empty", err.Error())
+		var validationErr *goqite.ValidationError
+		is.True(t, errors.As(err, &validationErr))
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+	})
+
+	t.Run("errors on a duplicate dedup key", func(t *testing.T) {
 		q := newQ(t, goqite.NewOpts{}, ":memory:")
 
-		m := &goqite.Message{
-			Body:  []byte("yo"),
-			Delay: 2 * time.Millisecond,
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Error(t, goqite.ErrDuplicate, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "b"})
+		is.NotError(t, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+	})
+
+	t.Run("errors on a duplicate dedup key with an ID func", func(t *testing.T) {
+		var i int
+		q := newQ(t, goqite.NewOpts{IDFunc: func() goqite.ID {
+			i++
+			return goqite.ID(fmt.Sprintf("id_%v", i))
+		}}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Error(t, goqite.ErrDuplicate, err)
+	})
+}
+
+func TestQueue_BusyRetries(t *testing.T) {
+	t.Run("retries an operation if the database is busy", func(t *testing.T) {
+		db, c := newBusyDB(t, 2)
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", BusyRetries: 2, BusyRetryDelay: time.Millisecond})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.Equal(t, 0, c.busy)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+	})
+
+	t.Run("gives up if the database is still busy after all retries", func(t *testing.T) {
+		db, _ := newBusyDB(t, 2)
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", BusyRetries: 1, BusyRetryDelay: time.Millisecond})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.True(t, err != nil)
+		is.True(t, strings.Contains(err.Error(), "database is locked"))
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", BusyRetries: 2})
+
+		var calls int
+		_, err := q.Outbox(context.Background(), func(tx *sql.Tx) (goqite.Message, error) {
+			calls++
+			return goqite.Message{}, errors.New("oh no")
+		})
+		is.Equal(t, "oh no", err.Error())
+		is.Equal(t, 1, calls)
+	})
+}
+
+func TestQueue_QueryHook(t *testing.T) {
+	t.Run("is called with the receive query, its arguments, and its duration", func(t *testing.T) {
+		type call struct {
+			query string
+			args  []any
+			d     time.Duration
+			err   error
+		}
+		var calls []call
+		q := newQ(t, goqite.NewOpts{QueryHook: func(query string, args []any, d time.Duration, err error) {
+			calls = append(calls, call{query: query, args: args, d: d, err: err})
+		}}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.Equal(t, 1, len(calls))
+		is.True(t, strings.Contains(calls[0].query, "insert into goqite"))
+
+		calls = nil
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, 1, len(calls))
+		is.True(t, strings.Contains(calls[0].query, "update goqite"))
+		is.Equal[any](t, "test", calls[0].args[1])
+		is.True(t, calls[0].d > 0)
+		is.NotError(t, calls[0].err)
+
+		calls = nil
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+		is.Equal(t, 1, len(calls))
+		is.Error(t, sql.ErrNoRows, calls[0].err)
+	})
+}
+
+func TestQueue_Receive_Order(t *testing.T) {
+	t.Run("receives messages with the same created timestamp in insertion order", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		// IDs in reverse order, so ordering by ID would give the wrong order
+		for _, id := range []string{"m_9", "m_5", "m_7", "m_1"} {
+			_, err := db.Exec(`insert into goqite (id, created, queue, body) values (?, '2024-01-01T00:00:00.000Z', 'test', ?)`,
+				id, []byte(id))
+			is.NotError(t, err)
+		}
+
+		for _, id := range []string{"m_9", "m_5", "m_7", "m_1"} {
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			is.Equal(t, goqite.ID(id), m.ID)
+		}
+	})
+}
+
+func TestQueue_ReceiveFilter(t *testing.T) {
+	t.Run("only receives messages matching the filter", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{ReceiveFilter: "length(body) >= ?", ReceiveFilterArgs: []any{3}}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("heya")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "heya", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("only receives messages older than the age in the filter", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{
+			ReceiveFilter:     "created <= strftime('%Y-%m-%dT%H:%M:%fZ', 'now', ?)",
+			ReceiveFilterArgs: []any{"-0.1 seconds"},
+		}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(150 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+	})
+
+	t.Run("composes with the visibility and queue predicates", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", ReceiveFilter: "1 = 1"})
+		other := goqite.New(goqite.NewOpts{DB: db, Name: "other"})
+
+		err := other.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), Delay: time.Second})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_Receive_Options(t *testing.T) {
+	t.Run("uses the visibility timeout option instead of the queue timeout", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Hour}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		before := time.Now()
+		m, err := q.Receive(context.Background(), goqite.WithVisibilityTimeout(time.Minute))
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.True(t, m.Timeout.After(before.Add(time.Minute-time.Second)))
+		is.True(t, m.Timeout.Before(before.Add(time.Minute+time.Second)))
+	})
+
+	t.Run("combines filters with the queue filter and the visibility timeout", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{ReceiveFilter: "length(body) >= ?", ReceiveFilterArgs: []any{3}}, ":memory:")
+
+		for _, body := range []string{"yo", "heya", "hello", "howdy"} {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+		}
+
+		opts := []goqite.ReceiveOption{
+			goqite.WithFilter("body like ?", "h%"),
+			goqite.WithFilter("length(body) = ?", 5),
+			goqite.WithVisibilityTimeout(time.Millisecond),
+		}
+
+		m, err := q.Receive(context.Background(), opts...)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "hello", string(m.Body))
+
+		time.Sleep(2 * time.Millisecond)
+
+		// The short visibility timeout has passed, so the first matching message is received again
+		m, err = q.Receive(context.Background(), opts...)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "hello", string(m.Body))
+		is.Equal(t, 2, m.Received)
+
+		m, err = q.Receive(context.Background(), goqite.WithFilter("body = ?", "yo"))
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("receives like before without options", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Hour}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.True(t, m.Timeout.After(time.Now().Add(59*time.Minute)))
+	})
+
+	t.Run("receives up to max messages with ReceiveMany, combined with the other options", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Hour}, ":memory:")
+
+		for _, body := range []string{"yo", "heya", "hello", "howdy"} {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+		}
+
+		before := time.Now()
+		ms, err := q.ReceiveMany(context.Background(), goqite.WithMax(2), goqite.WithFilter("body like ?", "h%"),
+			goqite.WithVisibilityTimeout(time.Minute))
+		is.NotError(t, err)
+		is.Equal(t, 2, len(ms))
+		is.Equal(t, "heya", string(ms[0].Body))
+		is.Equal(t, "hello", string(ms[1].Body))
+		for _, m := range ms {
+			is.True(t, m.Timeout.Before(before.Add(time.Minute+time.Second)))
+		}
+
+		ms, err = q.ReceiveMany(context.Background(), goqite.WithMax(10), goqite.WithFilter("body like ?", "h%"))
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, "howdy", string(ms[0].Body))
+
+		ms, err = q.ReceiveMany(context.Background(), goqite.WithFilter("body like ?", "h%"))
+		is.NotError(t, err)
+		is.Equal(t, 0, len(ms))
+
+		ms, err = q.ReceiveMany(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, "yo", string(ms[0].Body))
+	})
+
+	t.Run("panics on a max larger than one with Receive", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		defer func() {
+			is.Equal[any](t, "max cannot be larger than one, use ReceiveMany to receive more messages", recover())
+		}()
+		_, _ = q.Receive(context.Background(), goqite.WithMax(2))
+	})
+
+	t.Run("panics on a non-positive visibility timeout", func(t *testing.T) {
+		defer func() {
+			is.Equal[any](t, "visibility timeout must be larger than zero", recover())
+		}()
+		goqite.WithVisibilityTimeout(0)
+	})
+
+	t.Run("panics on a non-positive max", func(t *testing.T) {
+		defer func() {
+			is.Equal[any](t, "max must be larger than zero", recover())
+		}()
+		goqite.WithMax(0)
+	})
+}
+
+func TestQueue_StrictFIFO(t *testing.T) {
+	t.Run("does not receive later messages while the head is in flight", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{StrictFIFO: true, Timeout: 50 * time.Millisecond}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b")}})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "a", string(m.Body))
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		time.Sleep(50 * time.Millisecond)
+
+		m2, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, "a", string(m2.Body))
+
+		err = q.Delete(context.Background(), m2.ID)
+		is.NotError(t, err)
+
+		m2, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, "b", string(m2.Body))
+	})
+
+	t.Run("does not block on a head that has reached max receive", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 1, StrictFIFO: true, Timeout: time.Millisecond}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b")}})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "b", string(m.Body))
+	})
+}
+
+func TestQueue_SingleConsumer(t *testing.T) {
+	t.Run("receives messages in order and respects timeout and max receive", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 2, SingleConsumer: true, Timeout: 50 * time.Millisecond}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b")}})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "a", string(m.Body))
+		is.Equal(t, 1, m.Received)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "b", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(50 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "a", string(m.Body))
+		is.Equal(t, 2, m.Received)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "b", string(m.Body))
+
+		time.Sleep(50 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("receives each message once with concurrent consumers", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{SingleConsumer: true, Timeout: time.Minute}, ":memory:")
+
+		for i := 0; i < 100; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+		}
+
+		var mu sync.Mutex
+		received := map[goqite.ID]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					m, err := q.Receive(context.Background())
+					is.NotError(t, err)
+					if m == nil {
+						return
+					}
+					mu.Lock()
+					received[m.ID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		is.Equal(t, 100, len(received))
+		for _, n := range received {
+			is.Equal(t, 1, n)
+		}
+	})
+}
+
+func TestDepths(t *testing.T) {
+	t.Run("counts messages per queue", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		a := goqite.New(goqite.NewOpts{DB: db, Name: "a"})
+		b := goqite.New(goqite.NewOpts{DB: db, Name: "b"})
+
+		err := a.SendBatch(context.Background(), []goqite.Message{{Body: []byte("yo")}, {Body: []byte("yo")}})
+		is.NotError(t, err)
+		err = b.SendBatch(context.Background(), []goqite.Message{{Body: []byte("yo")}, {Body: []byte("yo"), Delay: time.Minute}})
+		is.NotError(t, err)
+
+		m, err := a.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		depths, err := goqite.Depths(context.Background(), db, false)
+		is.NotError(t, err)
+		is.Equal(t, 2, len(depths))
+		is.Equal(t, 2, depths["a"])
+		is.Equal(t, 2, depths["b"])
+
+		depths, err = goqite.Depths(context.Background(), db, true)
+		is.NotError(t, err)
+		is.Equal(t, 2, len(depths))
+		is.Equal(t, 1, depths["a"])
+		is.Equal(t, 1, depths["b"])
+	})
+}
+
+func TestQueue_SetMaxReceive(t *testing.T) {
+	t.Run("raising the max receive makes an exhausted message receivable again", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 2, Timeout: time.Millisecond}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		for i := 0; i < 2; i++ {
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		q.SetMaxReceive(3)
+		is.Equal(t, 3, q.MaxReceive())
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, 3, m.Received)
+	})
+
+	t.Run("does not change the max receive of clones", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 2}, ":memory:")
+		c := q.Clone(goqite.NewOpts{})
+
+		q.SetMaxReceive(5)
+		is.Equal(t, 2, c.MaxReceive())
+	})
+
+	t.Run("panics if not larger than zero", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		defer func() {
+			is.Equal[any](t, "max receive must be larger than zero", recover())
+		}()
+		q.SetMaxReceive(0)
+	})
+}
+
+func TestQueue_Clone(t *testing.T) {
+	t.Run("overrides the timeout and max receive without changing the original", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 1, Timeout: time.Millisecond}, ":memory:")
+		c := q.Clone(goqite.NewOpts{MaxReceive: 2, Timeout: time.Minute})
+		is.Equal(t, 1, q.MaxReceive())
+		is.Equal(t, 2, c.MaxReceive())
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := c.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.True(t, time.Until(m.Timeout) > 59*time.Second)
+
+		// The clone's longer timeout keeps the message in flight, for both queues
+		time.Sleep(time.Millisecond)
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		err = c.Nack(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		// The original queue's max receive of 1 has been reached, but not the clone's
+		m2, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		m2, err = c.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, 2, m2.Received)
+	})
+
+	t.Run("panics if the db or name is overridden", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		defer func() {
+			r := recover()
+			is.Equal[any](t, "db and name cannot be overridden", r)
+		}()
+		q.Clone(goqite.NewOpts{Name: "other"})
+	})
+}
+
+func TestQueue_ReceiveHandle(t *testing.T) {
+	t.Run("deletes the message on ack", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, ack, _, err := q.ReceiveHandle(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+
+		err = ack(context.Background())
+		is.NotError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("redelivers the message on nack", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, _, nack, err := q.ReceiveHandle(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = nack(context.Background())
+		is.NotError(t, err)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, m.ID, m2.ID)
+		is.Equal(t, 2, m2.Received)
+	})
+
+	t.Run("returns nil functions if there is no message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		m, ack, nack, err := q.ReceiveHandle(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+		is.True(t, ack == nil)
+		is.True(t, nack == nil)
+	})
+}
+
+func TestQueue_ReceiveID(t *testing.T) {
+	t.Run("receives a visible message that is not at the head of the queue", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		_, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("first")})
+		is.NotError(t, err)
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("second")})
+		is.NotError(t, err)
+
+		m, err := q.ReceiveID(context.Background(), id)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id, m.ID)
+		is.Equal(t, "second", string(m.Body))
+		is.Equal(t, 1, m.Received)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "first", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("returns nil if the message is in flight", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		m, err = q.ReceiveID(context.Background(), id)
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("returns nil if the message has been received the maximum number of times", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 1, Timeout: time.Millisecond}, ":memory:")
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.ReceiveID(context.Background(), id)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.ReceiveID(context.Background(), id)
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("returns ErrNotFound if there is no such message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		m, err := q.ReceiveID(context.Background(), "m_123")
+		is.Error(t, goqite.ErrNotFound, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_ReplayDeadLetters(t *testing.T) {
+	t.Run("moves dead-lettered messages back to the source queue", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", MaxReceive: 1, Timeout: time.Millisecond})
+		dlq := goqite.New(goqite.NewOpts{DB: db, Name: "dlq"})
+
+		for _, body := range []string{"1", "2", "3"} {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+
+			err = q.Archive(context.Background(), m.ID, "dlq")
+			is.NotError(t, err)
+		}
+
+		n, err := dlq.ReplayDeadLetters(context.Background(), "test", 2)
+		is.NotError(t, err)
+		is.Equal(t, 2, n)
+
+		for _, body := range []string{"1", "2"} {
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			is.Equal(t, body, string(m.Body))
+			is.Equal(t, 1, m.Received)
+		}
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		n, err = dlq.ReplayDeadLetters(context.Background(), "test", 2)
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+
+		n, err = dlq.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+}
+
+func TestQueue_ReplayDeadLettersWithRate(t *testing.T) {
+	t.Run("spreads out the replayed messages at the rate", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+		dlq := goqite.New(goqite.NewOpts{DB: db, Name: "dlq"})
+
+		for _, body := range []string{"1", "2", "3", "4"} {
+			id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+
+			err = q.Archive(context.Background(), id, "dlq")
+			is.NotError(t, err)
+		}
+
+		n, err := dlq.ReplayDeadLettersWithRate(context.Background(), "test", 10, 20)
+		is.NotError(t, err)
+		is.Equal(t, 4, n)
+
+		rows, err := db.Query(`select timeout from goqite where queue = 'test' order by timeout`)
+		is.NotError(t, err)
+		var timeouts []time.Time
+		for rows.Next() {
+			var timeout string
+			err = rows.Scan(&timeout)
+			is.NotError(t, err)
+			parsed, err := time.Parse("2006-01-02T15:04:05.000Z07:00", timeout)
+			is.NotError(t, err)
+			timeouts = append(timeouts, parsed)
+		}
+		is.NotError(t, rows.Err())
+		is.Equal(t, 4, len(timeouts))
+		for i := 1; i < len(timeouts); i++ {
+			is.Equal(t, 50*time.Millisecond, timeouts[i].Sub(timeouts[i-1]))
+		}
+
+		ms, err := q.Sample(context.Background(), 10)
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, "1", string(ms[0].Body))
+
+		time.Sleep(150 * time.Millisecond)
+
+		ms, err = q.Sample(context.Background(), 10)
+		is.NotError(t, err)
+		is.Equal(t, 4, len(ms))
+	})
+}
+
+func TestQueue_Archive(t *testing.T) {
+	t.Run("moves a processed message to the archive queue", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", Timeout: time.Millisecond})
+		archive := goqite.New(goqite.NewOpts{DB: db, Name: "archive"})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Archive(context.Background(), m.ID, "archive")
+		is.NotError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		m2, err = archive.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		var body string
+		err = db.QueryRow(`select body from goqite where queue = 'archive' and id = ?`, m.ID).Scan(&body)
+		is.NotError(t, err)
+		is.Equal(t, "yo", body)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+		n, err = archive.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+	})
+
+	t.Run("returns ErrNotFound if there is no such message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Archive(context.Background(), "m_123", "archive")
+		is.Error(t, goqite.ErrNotFound, err)
+	})
+}
+
+func TestQueue_Tombstone(t *testing.T) {
+	t.Run("does not receive a tombstoned message again", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", Timeout: time.Millisecond, Tombstone: true})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Delete(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		var count int
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 1, count)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+
+		// The dedup key is free again, like after a real delete
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+	})
+
+	t.Run("compacts tombstones after the retention", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", Tombstone: true})
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		err = q.Delete(context.Background(), id)
+		is.NotError(t, err)
+
+		n, err := q.Compact(context.Background(), time.Minute)
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+
+		time.Sleep(10 * time.Millisecond)
+
+		n, err = q.Compact(context.Background(), 5*time.Millisecond)
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+
+		var count int
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 1, count)
+
+		length, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, length)
+	})
+}
+
+func TestQueue_Vacuum(t *testing.T) {
+	t.Run("shrinks the database after deleting many messages", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		body := make([]byte, 1024)
+		var ms []goqite.Message
+		for i := 0; i < 1000; i++ {
+			ms = append(ms, goqite.Message{Body: body})
+		}
+		err := q.SendBatch(context.Background(), ms)
+		is.NotError(t, err)
+
+		_, err = db.Exec(`delete from goqite`)
+		is.NotError(t, err)
+
+		var before, after int
+		err = db.QueryRow(`pragma page_count`).Scan(&before)
+		is.NotError(t, err)
+
+		err = q.Vacuum(context.Background())
+		is.NotError(t, err)
+
+		err = db.QueryRow(`pragma page_count`).Scan(&after)
+		is.NotError(t, err)
+		is.True(t, after < before)
+	})
+}
+
+func TestQueueError(t *testing.T) {
+	t.Run("wraps database errors with the operation and queue name", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		tx, err := db.Begin()
+		is.NotError(t, err)
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		_, err = tx.Exec(`drop table goqite`)
+		is.NotError(t, err)
+
+		tests := []struct {
+			op  string
+			err error
+		}{
+			{"send", q.SendTx(context.Background(), tx, goqite.Message{Body: []byte("yo")})},
+			{"send", func() error {
+				_, _, err := q.SendIdempotentTx(context.Background(), tx, goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+				return err
+			}()},
+			{"receive", func() error { _, err := q.ReceiveTx(context.Background(), tx); return err }()},
+			{"extend", q.ExtendTx(context.Background(), tx, "m_123", time.Second)},
+			{"extend", func() error {
+				_, err := q.ExtendBatchTx(context.Background(), tx, []goqite.ID{"m_123"}, time.Second)
+				return err
+			}()},
+			{"delete", q.DeleteTx(context.Background(), tx, "m_123")},
+		}
+
+		for _, test := range tests {
+			t.Run(test.op, func(t *testing.T) {
+				var qErr *goqite.QueueError
+				is.True(t, errors.As(test.err, &qErr))
+				is.Equal(t, test.op, qErr.Op)
+				is.Equal(t, "test", qErr.Queue)
+				is.True(t, strings.HasPrefix(test.err.Error(), "goqite: "+test.op+" on queue test: no such table"))
+
+				var sqliteErr sqlite3.Error
+				is.True(t, errors.As(test.err, &sqliteErr))
+			})
+		}
+	})
+}
+
+func TestQueue_MaxReceive(t *testing.T) {
+	t.Run("returns the max receive count, and received messages have their received count", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxReceive: 2, Timeout: time.Millisecond}, ":memory:")
+		is.Equal(t, 2, q.MaxReceive())
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		for _, received := range []int{1, 2} {
+			time.Sleep(time.Millisecond)
+
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			is.Equal(t, received, m.Received)
+		}
+	})
+}
+
+func TestQueue_RedeliveryJitter(t *testing.T) {
+	t.Run("spreads the timeouts of received messages across the jitter window", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{RedeliveryJitter: time.Second, Timeout: time.Second}, ":memory:")
+
+		for i := 0; i < 20; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+		}
+
+		before := time.Now().Truncate(time.Millisecond)
+		var earliest, latest time.Time
+		for i := 0; i < 20; i++ {
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+
+			if earliest.IsZero() || m.Timeout.Before(earliest) {
+				earliest = m.Timeout
+			}
+			if m.Timeout.After(latest) {
+				latest = m.Timeout
+			}
+		}
+		after := time.Now()
+
+		is.True(t, !earliest.Before(before.Add(time.Second)))
+		is.True(t, !latest.After(after.Add(2*time.Second)))
+		is.True(t, latest.Sub(earliest) > 250*time.Millisecond)
+	})
+}
+
+func TestQueue_ReceiveTimeout(t *testing.T) {
+	t.Run("sets the message timeout to now plus the queue timeout", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: 30 * time.Minute}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		before := time.Now().Truncate(time.Millisecond)
+		m, err := q.Receive(context.Background())
+		after := time.Now()
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		is.True(t, !m.Timeout.Before(before.Add(30*time.Minute)))
+		is.True(t, !m.Timeout.After(after.Add(30*time.Minute)))
+	})
+}
+
+func TestQueue_Producer(t *testing.T) {
+	t.Run("round-trips the producer of a message", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		sender := goqite.New(goqite.NewOpts{DB: db, Name: "test", Producer: "api"})
+		receiver := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		err := sender.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		err = receiver.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := receiver.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "api", m.Producer)
+
+		m, err = receiver.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "", m.Producer)
+	})
+}
+
+func TestQueue_Receive(t *testing.T) {
+	t.Run("does not receive a delayed message immediately", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		m := &goqite.Message{
+			Body:  []byte("yo"),
+			Delay: 2 * time.Millisecond,
+		}
+
+		err := q.Send(context.Background(), *m)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(2 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+	})
+
+	t.Run("does not receive a message twice in a row", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		m := &goqite.Message{
+			Body: []byte("yo"),
+		}
+
+		err := q.Send(context.Background(), *m)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("does receive a message up to two times if set and timeout has passed", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond, MaxReceive: 2}, ":memory:")
+
+		m := &goqite.Message{
+			Body: []byte("yo"),
+		}
+
+		err := q.Send(context.Background(), *m)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("does not receive a message from a different queue", func(t *testing.T) {
+		q1 := newQ(t, goqite.NewOpts{}, "test.db")
+		q2 := newQ(t, goqite.NewOpts{Name: "q2"}, "test.db")
+
+		err := q1.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q2.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_ReceiveStream(t *testing.T) {
+	t.Run("streams a multi-megabyte body", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		h, r, err := q.ReceiveStream(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, h)
+		is.True(t, r == nil)
+
+		body := make([]byte, 3*1024*1024+1)
+		_, _ = rand.Read(body)
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: body})
+		is.NotError(t, err)
+
+		h, r, err = q.ReceiveStream(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, h)
+		is.Equal(t, id, h.ID)
+		is.Equal(t, 1, h.Received)
+		is.Equal(t, len(body), h.Size)
+
+		b, err := io.ReadAll(r)
+		is.NotError(t, err)
+		is.NotError(t, r.Close())
+		is.True(t, bytes.Equal(body, b))
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("errors if the message is deleted while reading", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		h, r, err := q.ReceiveStream(context.Background())
+		is.NotError(t, err)
+
+		err = q.Delete(context.Background(), h.ID)
+		is.NotError(t, err)
+
+		_, err = io.ReadAll(r)
+		is.Error(t, goqite.ErrNotFound, err)
+	})
+
+	t.Run("verifies the checksum at the end of the body", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", VerifyChecksum: true, CorruptQueue: "corrupt"})
+
+		body := make([]byte, 200*1024)
+		_, _ = rand.Read(body)
+
+		err := q.Send(context.Background(), goqite.Message{Body: body})
+		is.NotError(t, err)
+
+		_, r, err := q.ReceiveStream(context.Background())
+		is.NotError(t, err)
+
+		b, err := io.ReadAll(r)
+		is.NotError(t, err)
+		is.True(t, bytes.Equal(body, b))
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: body})
+		is.NotError(t, err)
+
+		_, err = db.Exec(`update goqite set body = zeroblob(length(body)) where id = ?`, id)
+		is.NotError(t, err)
+
+		_, r, err = q.ReceiveStream(context.Background())
+		is.NotError(t, err)
+
+		_, err = io.ReadAll(r)
+		is.Error(t, goqite.ErrCorrupt, err)
+
+		var queue string
+		err = db.QueryRow(`select queue from goqite where id = ?`, id).Scan(&queue)
+		is.NotError(t, err)
+		is.Equal(t, "corrupt", queue)
+	})
+}
+
+func TestQueue_ReceiveAndDelete(t *testing.T) {
+	t.Run("receives a message and deletes it immediately", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		m, err := q.ReceiveAndDelete(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err = q.ReceiveAndDelete(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+
+		err = q.ResetReceived(context.Background(), m.ID)
+		is.Error(t, goqite.ErrNotFound, err)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_SendAndGetID(t *testing.T) {
+	t.Run("returns the message ID", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		m := goqite.Message{
+			Body: []byte("yo"),
+		}
+
+		id, err := q.SendAndGetID(context.Background(), m)
+		is.NotError(t, err)
+		is.Equal(t, 34, len(id))
+
+		err = q.Delete(context.Background(), id)
+		is.NotError(t, err)
+	})
+
+	t.Run("returns the message ID from the ID func if set", func(t *testing.T) {
+		var i int
+		q := newQ(t, goqite.NewOpts{IDFunc: func() goqite.ID {
+			i++
+			return goqite.ID(fmt.Sprintf("id_%v", i))
+		}}, ":memory:")
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.Equal(t, "id_1", id)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "id_1", m.ID)
+	})
+
+	t.Run("returns a message ID with the ID prefix if set", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{IDPrefix: "job_"}, ":memory:")
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.True(t, strings.HasPrefix(string(id), "job_"))
+		is.Equal(t, 36, len(id))
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		for i := 0; i < 2; i++ {
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			is.True(t, strings.HasPrefix(string(m.ID), "job_"))
+		}
+	})
+}
+
+func TestQueue_SendAfter(t *testing.T) {
+	t.Run("sends a message that can be received after the delay", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		id, err := q.SendAfter(context.Background(), []byte("yo"), 10*time.Millisecond)
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(10 * time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id, m.ID)
+		is.Equal(t, "yo", string(m.Body))
+	})
+}
+
+func TestQueue_SendAt(t *testing.T) {
+	t.Run("sends a message that can be received at the given time", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		at := time.Now().Add(10 * time.Millisecond)
+		id, err := q.SendAt(context.Background(), []byte("yo"), at)
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(time.Until(at))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id, m.ID)
+	})
+
+	t.Run("errors if the time is in the past", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		_, err := q.SendAt(context.Background(), []byte("yo"), time.Now().Add(-time.Second))
+		is.Equal(t, "send time must be in the future", err.Error())
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_SendIdempotent(t *testing.T) {
+	t.Run("returns the existing message ID for a duplicate dedup key", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		id, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, created)
+		is.Equal(t, 34, len(id))
+
+		id2, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, !created)
+		is.Equal(t, id, id2)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("returns the existing message ID for a duplicate dedup key in a full queue", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxDepth: 1}, ":memory:")
+
+		id, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, created)
+
+		id2, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, !created)
+		is.Equal(t, id, id2)
+
+		_, _, err = q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "b"})
+		is.Error(t, goqite.ErrQueueFull, err)
+	})
+
+	t.Run("creates a new message with the same dedup key in a different queue", func(t *testing.T) {
+		q1 := newQ(t, goqite.NewOpts{}, "test.db")
+		q2 := newQ(t, goqite.NewOpts{Name: "q2"}, "test.db")
+
+		id1, created, err := q1.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, created)
+
+		id2, created, err := q2.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, created)
+		is.True(t, id1 != id2)
+	})
+
+	t.Run("creates a new message with the same dedup key after the first is deleted", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		id, _, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		err = q.Delete(context.Background(), id)
+		is.NotError(t, err)
+
+		id2, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, created)
+		is.True(t, id != id2)
+	})
+
+	t.Run("uses the ID func if set", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{IDFunc: func() goqite.ID {
+			return "id_1"
+		}}, ":memory:")
+
+		id, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, created)
+		is.Equal(t, "id_1", id)
+	})
+}
+
+func TestQueue_VerifyChecksum(t *testing.T) {
+	t.Run("returns ErrCorrupt when receiving a message with a tampered body", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", VerifyChecksum: true})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("heya")})
+		is.NotError(t, err)
+
+		_, err = db.Exec(`update goqite set body = x'796e' where body = x'796f'`)
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.Error(t, goqite.ErrCorrupt, err)
+		is.Nil(t, m)
+
+		// The corrupt message receive counts, so the next message is received after it
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "heya", string(m.Body))
+	})
+
+	t.Run("moves corrupt messages to the corrupt queue", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", VerifyChecksum: true, CorruptQueue: "corrupt"})
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		_, err = db.Exec(`update goqite set body = x'796e'`)
+		is.NotError(t, err)
+
+		_, err = q.ReceiveID(context.Background(), id)
+		is.Error(t, goqite.ErrCorrupt, err)
+
+		var queue string
+		err = db.QueryRow(`select queue from goqite where id = ?`, id).Scan(&queue)
+		is.NotError(t, err)
+		is.Equal(t, "corrupt", queue)
+	})
+
+	t.Run("does not verify messages sent without a checksum", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		sender := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test", VerifyChecksum: true})
+
+		err := sender.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		_, err = db.Exec(`update goqite set body = x'796e'`)
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yn", string(m.Body))
+	})
+
+	t.Run("panics with a corrupt queue but without verify checksum", func(t *testing.T) {
+		defer func() {
+			is.Equal[any](t, "corrupt queue given without verify checksum", recover())
+		}()
+		goqite.New(goqite.NewOpts{DB: newDB(t, ":memory:"), Name: "test", CorruptQueue: "corrupt"})
+	})
+}
+
+func TestQueue_DedupBody(t *testing.T) {
+	t.Run("returns the existing message ID for an identical body", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupBody: true}, ":memory:")
+
+		id1, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		id2, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.Equal(t, id1, id2)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+	})
+
+	t.Run("does not dedup different bodies", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupBody: true}, ":memory:")
+
+		id1, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		id2, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("hey")})
+		is.NotError(t, err)
+		is.True(t, id1 != id2)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 2, n)
+	})
+
+	t.Run("does not dedup an identical body after the window", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupBody: true, DedupBodyWindow: time.Millisecond}, ":memory:")
+
+		id1, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		time.Sleep(2 * time.Millisecond)
+
+		id2, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.True(t, id1 != id2)
+	})
+
+	t.Run("does not dedup an identical body after the message is deleted", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupBody: true}, ":memory:")
+
+		id1, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		err = q.Delete(context.Background(), id1)
+		is.NotError(t, err)
+
+		id2, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		is.True(t, id1 != id2)
+	})
+
+	t.Run("returns the existing message ID for an identical body sent idempotently", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupBody: true}, ":memory:")
+
+		id1, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		id2, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, !created)
+		is.Equal(t, id1, id2)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+	})
+}
+
+func TestQueue_DedupWindow(t *testing.T) {
+	t.Run("rejects a duplicate within the window and accepts it after", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{DedupWindow: 50 * time.Millisecond}, ":memory:")
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Error(t, goqite.ErrDuplicate, err)
+
+		id2, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, !created)
+		is.Equal(t, id, id2)
+
+		time.Sleep(60 * time.Millisecond)
+
+		id3, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, id != id3)
+
+		id4, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		is.True(t, !created)
+		is.Equal(t, id3, id4)
+	})
+}
+
+func TestQueue_Outbox(t *testing.T) {
+	t.Run("sends the message and commits the domain write together", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		_, err := db.Exec(`create table things (name text not null)`)
+		is.NotError(t, err)
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		id, err := q.Outbox(context.Background(), func(tx *sql.Tx) (goqite.Message, error) {
+			_, err := tx.Exec(`insert into things (name) values ('thing')`)
+			return goqite.Message{Body: []byte("yo")}, err
+		})
+		is.NotError(t, err)
+
+		var count int
+		err = db.QueryRow(`select count(*) from things`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 1, count)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id, m.ID)
+	})
+
+	t.Run("rolls back the domain write and the send on error", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		_, err := db.Exec(`create table things (name text not null)`)
+		is.NotError(t, err)
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		_, err = q.Outbox(context.Background(), func(tx *sql.Tx) (goqite.Message, error) {
+			if _, err := tx.Exec(`insert into things (name) values ('thing')`); err != nil {
+				return goqite.Message{}, err
+			}
+			return goqite.Message{}, errors.New("oh no")
+		})
+		is.Equal(t, "oh no", err.Error())
+
+		var count int
+		err = db.QueryRow(`select count(*) from things`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("logs a panic and rolls back before panicking again", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		_, err := db.Exec(`create table things (name text not null)`)
+		is.NotError(t, err)
+
+		var logged []any
+		log := testLogger(func(msg string, args ...any) {
+			if msg == "Recovered from panic in transaction, rolled back and panicking again" {
+				logged = args
+			}
+		})
+		q := goqite.New(goqite.NewOpts{DB: db, Log: log, Name: "test"})
+
+		func() {
+			defer func() {
+				is.Equal[any](t, "oh no", recover())
+			}()
+			_, _ = q.Outbox(context.Background(), func(tx *sql.Tx) (goqite.Message, error) {
+				if _, err := tx.Exec(`insert into things (name) values ('thing')`); err != nil {
+					return goqite.Message{}, err
+				}
+				panic("oh no")
+			})
+		}()
+
+		is.Equal(t, 6, len(logged))
+		is.Equal[any](t, "name", logged[0])
+		is.Equal[any](t, "test", logged[1])
+		is.Equal[any](t, "op", logged[2])
+		is.Equal[any](t, "outbox", logged[3])
+		is.Equal[any](t, "error", logged[4])
+		is.Equal[any](t, "oh no", logged[5])
+
+		var count int
+		err = db.QueryRow(`select count(*) from things`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+	})
+}
+
+func TestQueue_Touch(t *testing.T) {
+	t.Run("updates the updated timestamp but not the timeout or received count", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		var updatedBefore, timeoutBefore string
+		var receivedBefore int
+		err = db.QueryRow(`select updated, timeout, received from goqite where id = ?`, m.ID).Scan(&updatedBefore, &timeoutBefore, &receivedBefore)
+		is.NotError(t, err)
+
+		time.Sleep(2 * time.Millisecond)
+
+		err = q.Touch(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		var updated, timeout string
+		var received int
+		err = db.QueryRow(`select updated, timeout, received from goqite where id = ?`, m.ID).Scan(&updated, &timeout, &received)
+		is.NotError(t, err)
+		is.True(t, updated > updatedBefore)
+		is.Equal(t, timeoutBefore, timeout)
+		is.Equal(t, receivedBefore, received)
+	})
+
+	t.Run("returns ErrNotFound if the message is not in the queue", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+		other := goqite.New(goqite.NewOpts{DB: db, Name: "other"})
+
+		id, err := other.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		err = q.Touch(context.Background(), id)
+		is.Error(t, goqite.ErrNotFound, err)
+	})
+}
+
+func TestQueue_ExportAndImport(t *testing.T) {
+	t.Run("round-trips messages to a queue in another database", func(t *testing.T) {
+		from := newQ(t, goqite.NewOpts{Producer: "app", Timeout: time.Minute}, ":memory:")
+		to := newQ(t, goqite.NewOpts{Name: "imported"}, ":memory:")
+
+		id1, err := from.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.NotError(t, err)
+		id2, err := from.SendAndGetID(context.Background(), goqite.Message{Body: []byte("heya")})
+		is.NotError(t, err)
+		_, err = from.SendAndGetID(context.Background(), goqite.Message{Body: []byte("later"), Delay: time.Hour})
+		is.NotError(t, err)
+
+		// Receive and release the first message, so it has a received count
+		m, err := from.Receive(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, id1, m.ID)
+		err = from.Nack(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		var buf bytes.Buffer
+		err = from.Export(context.Background(), &buf)
+		is.NotError(t, err)
+		is.Equal(t, 3, strings.Count(buf.String(), "\n"))
+
+		n, err := to.Import(context.Background(), &buf)
+		is.NotError(t, err)
+		is.Equal(t, 3, n)
+
+		m, err = to.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id1, m.ID)
+		is.Equal(t, "yo", string(m.Body))
+		is.Equal(t, "app", m.Producer)
+		is.Equal(t, 2, m.Received)
+
+		m, err = to.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id2, m.ID)
+		is.Equal(t, 1, m.Received)
+
+		// The delayed message keeps its remaining delay
+		m, err = to.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		// The dedup key is kept
+		err = to.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Error(t, goqite.ErrDuplicate, err)
+	})
+
+	t.Run("imports nothing if a message cannot be imported", func(t *testing.T) {
+		from := newQ(t, goqite.NewOpts{}, ":memory:")
+		to := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := from.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		var buf bytes.Buffer
+		err = from.Export(context.Background(), &buf)
+		is.NotError(t, err)
+		buf.WriteString(buf.String())
+
+		_, err = to.Import(context.Background(), &buf)
+		is.True(t, err != nil)
+
+		n, err := to.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+
+	t.Run("validates messages and respects the max depth", func(t *testing.T) {
+		from := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := from.SendBatch(context.Background(), []goqite.Message{{Body: []byte("yo")}, {Body: []byte("no")}})
+		is.NotError(t, err)
+
+		var buf bytes.Buffer
+		err = from.Export(context.Background(), &buf)
+		is.NotError(t, err)
+		exported := buf.String()
+
+		errInvalid := errors.New("invalid")
+		to := newQ(t, goqite.NewOpts{Validate: func(m goqite.Message) error {
+			if string(m.Body) == "no" {
+				return errInvalid
+			}
+			return nil
+		}}, ":memory:")
+
+		_, err = to.Import(context.Background(), strings.NewReader(exported))
+		is.Error(t, errInvalid, err)
+
+		var validationErr *goqite.ValidationError
+		is.True(t, errors.As(err, &validationErr))
+
+		to = newQ(t, goqite.NewOpts{MaxDepth: 1}, ":memory:")
+
+		_, err = to.Import(context.Background(), strings.NewReader(exported))
+		is.Error(t, goqite.ErrQueueFull, err)
+
+		var qErr *goqite.QueueError
+		is.True(t, errors.As(err, &qErr))
+		is.Equal(t, "import", qErr.Op)
+
+		n, err := to.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+}
+
+func TestNewInMemory(t *testing.T) {
+	t.Run("queues on databases with the same name see each other's messages", func(t *testing.T) {
+		db1, err := goqite.NewInMemory("sqlite3", t.Name())
+		is.NotError(t, err)
+		defer func() {
+			_ = db1.Close()
+		}()
+
+		err = goqite.Setup(context.Background(), db1)
+		is.NotError(t, err)
+
+		db2, err := goqite.NewInMemory("sqlite3", t.Name())
+		is.NotError(t, err)
+		defer func() {
+			_ = db2.Close()
+		}()
+
+		q1 := goqite.New(goqite.NewOpts{DB: db1, Name: "test"})
+		q2 := goqite.New(goqite.NewOpts{DB: db2, Name: "test"})
+
+		err = q1.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q2.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+	})
+
+	t.Run("databases with different names are separate", func(t *testing.T) {
+		db1, err := goqite.NewInMemory("sqlite3", t.Name()+"1")
+		is.NotError(t, err)
+		defer func() {
+			_ = db1.Close()
+		}()
+
+		err = goqite.Setup(context.Background(), db1)
+		is.NotError(t, err)
+
+		db2, err := goqite.NewInMemory("sqlite3", t.Name()+"2")
+		is.NotError(t, err)
+		defer func() {
+			_ = db2.Close()
+		}()
+
+		var exists bool
+		err = db2.QueryRow(`select exists (select 1 from sqlite_master where name = 'goqite')`).Scan(&exists)
+		is.NotError(t, err)
+		is.True(t, !exists)
+	})
+
+	t.Run("sets the busy timeout and foreign keys with pragmas", func(t *testing.T) {
+		db, err := goqite.NewInMemory("sqlite3", t.Name())
+		is.NotError(t, err)
+		defer func() {
+			_ = db.Close()
+		}()
+
+		var timeout int
+		err = db.QueryRow(`pragma busy_timeout`).Scan(&timeout)
+		is.NotError(t, err)
+		is.Equal(t, 5000, timeout)
+
+		var fk bool
+		err = db.QueryRow(`pragma foreign_keys`).Scan(&fk)
+		is.NotError(t, err)
+		is.True(t, fk)
+	})
+}
+
+func TestQueue_ApproxLen(t *testing.T) {
+	t.Run("matches the message count in the queue", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q1 := goqite.New(goqite.NewOpts{DB: db, Name: "q1"})
+		q2 := goqite.New(goqite.NewOpts{DB: db, Name: "q2"})
+
+		n, err := q1.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+
+		for i := 0; i < 10; i++ {
+			err := q1.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+		}
+		err = q2.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		for i := 0; i < 4; i++ {
+			m, err := q1.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			err = q1.Delete(context.Background(), m.ID)
+			is.NotError(t, err)
+		}
+
+		var count int
+		err = db.QueryRow(`select count(*) from goqite where queue = 'q1'`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 6, count)
+
+		n, err = q1.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, count, n)
+
+		n, err = q2.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+	})
+}
+
+func TestQueue_Stats(t *testing.T) {
+	t.Run("returns message counts and body sizes", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		stats, err := q.Stats(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, goqite.Stats{}, stats)
+
+		for _, size := range []int{1, 10, 100, 1} {
+			err := q.Send(context.Background(), goqite.Message{Body: bytes.Repeat([]byte("a"), size)})
+			is.NotError(t, err)
+		}
+
+		other := goqite.New(goqite.NewOpts{DB: db, Name: "other"})
+		err = other.Send(context.Background(), goqite.Message{Body: bytes.Repeat([]byte("a"), 1000)})
+		is.NotError(t, err)
+
+		stats, err = q.Stats(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, goqite.Stats{Messages: 4, TotalBodyBytes: 112, MaxBodyBytes: 100, AvgBodyBytes: 28}, stats)
+	})
+}
+
+func TestQueue_Drain(t *testing.T) {
+	t.Run("returns once a consumer has processed all messages", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		for i := 0; i < 3; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+		}
+
+		var processed atomic.Int64
+		go func() {
+			for {
+				m, err := q.Receive(context.Background())
+				if err != nil || m == nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+				processed.Add(1)
+				if err := q.Delete(context.Background(), m.ID); err != nil {
+					return
+				}
+			}
+		}()
+
+		err := q.Drain(context.Background(), time.Millisecond)
+		is.NotError(t, err)
+		is.Equal(t, int64(3), processed.Load())
+	})
+
+	t.Run("returns the context error if the queue is not empty", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err = q.Drain(ctx, time.Millisecond)
+		is.Error(t, context.DeadlineExceeded, err)
+	})
+}
+
+func TestQueue_OldestVisibleAge(t *testing.T) {
+	t.Run("returns the age of the oldest never-received visible message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		age, err := q.OldestVisibleAge(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, time.Duration(0), age)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("received")})
+		is.NotError(t, err)
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("delayed"), Delay: time.Minute})
+		is.NotError(t, err)
+
+		age, err = q.OldestVisibleAge(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, time.Duration(0), age)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("old")})
+		is.NotError(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("new")})
+		is.NotError(t, err)
+
+		age, err = q.OldestVisibleAge(context.Background())
+		is.NotError(t, err)
+		is.True(t, age >= 50*time.Millisecond)
+		is.True(t, age < time.Second)
+	})
+}
+
+func TestQueue_Sample(t *testing.T) {
+	t.Run("returns receivable messages without receiving them", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		for _, body := range []string{"1", "2", "3"} {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+		}
+
+		ms, err := q.Sample(context.Background(), 2)
+		is.NotError(t, err)
+		is.Equal(t, 2, len(ms))
+		is.Equal(t, "1", string(ms[0].Body))
+		is.Equal(t, "2", string(ms[1].Body))
+		is.Equal(t, 0, ms[0].Received)
+
+		ms, err = q.Sample(context.Background(), 10)
+		is.NotError(t, err)
+		is.Equal(t, 3, len(ms))
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "1", string(m.Body))
+		is.Equal(t, 1, m.Received)
+
+		ms, err = q.Sample(context.Background(), 10)
+		is.NotError(t, err)
+		is.Equal(t, 2, len(ms))
+		is.Equal(t, "2", string(ms[0].Body))
+	})
+}
+
+func TestQueue_InFlight(t *testing.T) {
+	t.Run("lists received messages until they are deleted", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+
+		for _, body := range []string{"1", "2"} {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+		}
+
+		ms, err := q.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, len(ms))
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		ms, err = q.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, m.ID, ms[0].ID)
+		is.Equal(t, "1", string(ms[0].Body))
+		is.Equal(t, 1, ms[0].Received)
+		is.True(t, time.Until(ms[0].Timeout) > 59*time.Second)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, "2", string(m2.Body))
+
+		err = q.Delete(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		ms, err = q.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, m2.ID, ms[0].ID)
+	})
+}
+
+func TestQueue_ListMessages(t *testing.T) {
+	t.Run("pages through all messages in the queue", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		ids := map[goqite.ID]bool{}
+		for i := 0; i < 5; i++ {
+			id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte(fmt.Sprint(i))})
+			is.NotError(t, err)
+			ids[id] = true
+		}
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		var pages int
+		var cursor string
+		for {
+			ms, next, err := q.ListMessages(context.Background(), goqite.ListOpts{Cursor: cursor, Limit: 2})
+			is.NotError(t, err)
+			pages++
+			for _, m := range ms {
+				is.True(t, ids[m.ID])
+				delete(ids, m.ID)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		is.Equal(t, 3, pages)
+		is.Equal(t, 0, len(ids))
+	})
+
+	t.Run("returns an empty page for an empty queue", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		ms, cursor, err := q.ListMessages(context.Background(), goqite.ListOpts{})
+		is.NotError(t, err)
+		is.Equal(t, 0, len(ms))
+		is.Equal(t, "", cursor)
+	})
+
+	t.Run("errors on an invalid cursor", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		_, _, err := q.ListMessages(context.Background(), goqite.ListOpts{Cursor: "notacursor"})
+		is.Equal(t, "invalid cursor", err.Error())
+	})
+
+	t.Run("does not affect message visibility", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		ms, _, err := q.ListMessages(context.Background(), goqite.ListOpts{})
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, "yo", string(ms[0].Body))
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+	})
+}
+
+func TestQueue_ExtendBatch(t *testing.T) {
+	t.Run("extends all listed in-flight messages and returns the count", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: 50 * time.Millisecond}, ":memory:")
+
+		var ids []goqite.ID
+		for i := 0; i < 3; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+			ids = append(ids, m.ID)
+		}
+
+		n, err := q.ExtendBatch(context.Background(), append(ids, "m_doesnotexist"), time.Second)
+		is.NotError(t, err)
+		is.Equal(t, 3, n)
+
+		time.Sleep(50 * time.Millisecond)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("does nothing with no ids", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		n, err := q.ExtendBatch(context.Background(), nil, time.Second)
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+}
+
+func TestQueue_Extend(t *testing.T) {
+	t.Run("does not receive a message that has had the timeout extended", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		m := &goqite.Message{
+			Body: []byte("yo"),
+		}
+
+		err := q.Send(context.Background(), *m)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Extend(context.Background(), m.ID, time.Second)
+		is.NotError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("panics if delay is negative", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		var err error
+		defer func() {
+			is.NotError(t, err)
+			r := recover()
+			is.Equal(t, "delay cannot be negative", r)
+		}()
+
+		m := &goqite.Message{
+			Body: []byte("yo"),
+		}
+
+		err = q.Send(context.Background(), *m)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Extend(context.Background(), m.ID, -1)
+	})
+}
+
+func TestQueue_Ack(t *testing.T) {
+	t.Run("removes the message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Ack(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_ReapExpiredLeases(t *testing.T) {
+	t.Run("releases a message with a stale heartbeat", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Heartbeat(context.Background(), m.ID, time.Millisecond)
+		is.NotError(t, err)
+
+		// The consumer dies and stops sending heartbeats
+		time.Sleep(2 * time.Millisecond)
+
+		n, err := q.ReapExpiredLeases(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, 2, m.Received)
+
+		// The new consumer's lease is not affected by the old heartbeat
+		n, err = q.ReapExpiredLeases(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+
+	t.Run("does not release a message with a fresh heartbeat or without heartbeats", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+
+		for _, body := range []string{"1", "2"} {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte(body)})
+			is.NotError(t, err)
+		}
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Heartbeat(context.Background(), m.ID, time.Minute)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		n, err := q.ReapExpiredLeases(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("returns ErrNotFound on heartbeat if there is no such message", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Heartbeat(context.Background(), "m_123", time.Minute)
+		is.Error(t, goqite.ErrNotFound, err)
+	})
+}
+
+func TestQueue_Nack(t *testing.T) {
+	t.Run("makes the message immediately receivable again", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		err = q.Nack(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, m.ID, m2.ID)
+	})
+}
+
+func TestQueue_ResetReceived(t *testing.T) {
+	t.Run("makes a message at max receive deliverable again", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond, MaxReceive: 1}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		time.Sleep(time.Millisecond)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		err = q.ResetReceived(context.Background(), m.ID)
+		is.NotError(t, err)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+	})
+
+	t.Run("errors if the message does not exist", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.ResetReceived(context.Background(), "m_123")
+		is.Error(t, goqite.ErrNotFound, err)
+	})
+}
+
+func TestQueue_ExtendUntil(t *testing.T) {
+	t.Run("does not receive a message until the given time", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		until := time.Now().Add(50 * time.Millisecond)
+		err = q.ExtendUntil(context.Background(), m.ID, until)
+		is.NotError(t, err)
+
+		time.Sleep(time.Until(until) - 10*time.Millisecond)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		time.Sleep(time.Until(until) + time.Millisecond)
+
+		m2, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, m.ID, m2.ID)
+	})
+
+	t.Run("does not receive a message until the given time in another zone", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+
+		_, offset := time.Now().Zone()
+		zone := time.FixedZone("elsewhere", offset+5*60*60)
+		until := time.Now().Add(50 * time.Millisecond).In(zone)
+		err = q.ExtendUntil(context.Background(), m.ID, until)
+		is.NotError(t, err)
+
+		time.Sleep(time.Until(until) - 10*time.Millisecond)
+
+		m2, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m2)
+
+		time.Sleep(time.Until(until) + time.Millisecond)
+
+		m2, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m2)
+		is.Equal(t, m.ID, m2.ID)
+	})
+
+	t.Run("errors if the time is not in the future", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.ExtendUntil(context.Background(), "m_123", time.Now().Add(-time.Second))
+		is.Equal(t, "timeout must be in the future", err.Error())
+	})
+}
+
+func TestQueue_RetryExhausted(t *testing.T) {
+	t.Run("makes exhausted messages deliverable again and leaves others untouched", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond, MaxReceive: 1}, ":memory:")
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("exhausted")})
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id, m.ID)
+
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("fresh"), Delay: 10 * time.Millisecond})
+		is.NotError(t, err)
+
+		n, err := q.RetryExhausted(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "exhausted", string(m.Body))
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestQueue_ReceiveBatchWithWait(t *testing.T) {
+	t.Run("returns a full batch as soon as it has filled up across polls", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("1")})
+		is.NotError(t, err)
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_ = q.Send(context.Background(), goqite.Message{Body: []byte("2")})
+			_ = q.Send(context.Background(), goqite.Message{Body: []byte("3")})
+		}()
+
+		before := time.Now()
+		ms, err := q.ReceiveBatchWithWait(context.Background(), 3, time.Second, time.Millisecond)
+		is.NotError(t, err)
+		is.True(t, time.Since(before) < 500*time.Millisecond)
+		is.Equal(t, 3, len(ms))
+		for i, m := range ms {
+			is.Equal(t, fmt.Sprint(i+1), string(m.Body))
+		}
+	})
+
+	t.Run("returns a partial batch after the max wait", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("1")})
+		is.NotError(t, err)
+
+		before := time.Now()
+		ms, err := q.ReceiveBatchWithWait(context.Background(), 3, 50*time.Millisecond, time.Millisecond)
+		is.NotError(t, err)
+		is.True(t, time.Since(before) >= 50*time.Millisecond)
+		is.Equal(t, 1, len(ms))
+	})
+
+	t.Run("returns an empty batch after the max wait if there are no messages", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		ms, err := q.ReceiveBatchWithWait(context.Background(), 3, 10*time.Millisecond, time.Millisecond)
+		is.NotError(t, err)
+		is.Equal(t, 0, len(ms))
+	})
+}
+
+func TestQueue_ReceiveAndWait(t *testing.T) {
+	t.Run("waits for a message until the context is cancelled", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+
+		m, err := q.ReceiveAndWait(ctx, time.Millisecond)
+		is.Error(t, context.DeadlineExceeded, err)
+		is.Error(t, goqite.ErrReceiveTimeout, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("does not return a receive timeout error if the context is cancelled", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond, cancel)
+
+		m, err := q.ReceiveAndWait(ctx, time.Millisecond)
+		is.Error(t, context.Canceled, err)
+		is.True(t, !errors.Is(err, goqite.ErrReceiveTimeout))
+		is.Nil(t, m)
+	})
+
+	t.Run("gets a message immediately if there is one", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		m, err := q.ReceiveAndWait(context.Background(), time.Millisecond)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
+	})
+}
+
+func TestReceiveFromFirst(t *testing.T) {
+	t.Run("prefers earlier queues and falls through to later ones", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		high := goqite.New(goqite.NewOpts{DB: db, Name: "high"})
+		normal := goqite.New(goqite.NewOpts{DB: db, Name: "normal"})
+		queues := []*goqite.Queue{high, normal}
+
+		err := normal.Send(context.Background(), goqite.Message{Body: []byte("normal")})
+		is.NotError(t, err)
+		err = high.Send(context.Background(), goqite.Message{Body: []byte("high")})
+		is.NotError(t, err)
+
+		m, q, err := goqite.ReceiveFromFirst(context.Background(), queues)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "high", string(m.Body))
+		is.Equal(t, high, q)
+
+		m, q, err = goqite.ReceiveFromFirst(context.Background(), queues)
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "normal", string(m.Body))
+		is.Equal(t, normal, q)
+
+		m, q, err = goqite.ReceiveFromFirst(context.Background(), queues)
+		is.NotError(t, err)
+		is.Nil(t, m)
+		is.Nil(t, q)
+	})
+}
+
+func TestQueue_ReceiveN(t *testing.T) {
+	t.Run("receives up to n messages", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b")}, {Body: []byte("c")}})
+		is.NotError(t, err)
+
+		var bodies []string
+		q.ReceiveN(context.Background(), 2)(func(m *goqite.Message, err error) bool {
+			is.NotError(t, err)
+			bodies = append(bodies, string(m.Body))
+			return true
+		})
+		is.Equal(t, "a b", strings.Join(bodies, " "))
+	})
+
+	t.Run("stops when the queue is empty", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("a")})
+		is.NotError(t, err)
+
+		var count int
+		q.ReceiveN(context.Background(), 10)(func(m *goqite.Message, err error) bool {
+			is.NotError(t, err)
+			count++
+			return true
+		})
+		is.Equal(t, 1, count)
+	})
+
+	t.Run("does not claim more messages after breaking early", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := q.SendBatch(context.Background(), []goqite.Message{{Body: []byte("a")}, {Body: []byte("b")}, {Body: []byte("c")}})
+		is.NotError(t, err)
+
+		var count int
+		q.ReceiveN(context.Background(), 3)(func(m *goqite.Message, err error) bool {
+			is.NotError(t, err)
+			count++
+			return false
+		})
+		is.Equal(t, 1, count)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "b", string(m.Body))
+	})
+}
+
+func TestQueue_Stream(t *testing.T) {
+	t.Run("sends messages on the channel until the context is cancelled", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{}, ":memory:")
+
+		for i := 0; i < 3; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ms := q.Stream(ctx, time.Millisecond)
+
+		ids := map[goqite.ID]bool{}
+		for i := 0; i < 3; i++ {
+			m := <-ms
+			is.NotNil(t, m)
+			is.Equal(t, "yo", string(m.Body))
+			ids[m.ID] = true
+
+			err := q.Delete(context.Background(), m.ID)
+			is.NotError(t, err)
+		}
+		is.Equal(t, 3, len(ids))
+
+		cancel()
+
+		for range ms {
+			t.Fatal("expected no more messages")
+		}
+	})
+}
+
+func TestNew_AutoSetup(t *testing.T) {
+	t.Run("creates the schema in a fresh database", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", ":memory:?_journal=WAL&_timeout=5000&_fk=true")
+		if err != nil {
+			t.Fatal(err)
 		}
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
 
-		err := q.Send(context.Background(), *m)
-		is.NotError(t, err)
+		q := goqite.New(goqite.NewOpts{AutoSetup: true, DB: db, Name: "test"})
 
-		m, err = q.Receive(context.Background())
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
 		is.NotError(t, err)
-		is.Nil(t, m)
 
-		time.Sleep(2 * time.Millisecond)
+		q = goqite.New(goqite.NewOpts{AutoSetup: true, DB: db, Name: "test"})
 
-		m, err = q.Receive(context.Background())
+		m, err := q.Receive(context.Background())
 		is.NotError(t, err)
 		is.NotNil(t, m)
 		is.Equal(t, "yo", string(m.Body))
 	})
+}
 
-	t.Run("does not receive a message twice in a row", func(t *testing.T) {
-		q := newQ(t, goqite.NewOpts{}, ":memory:")
-
-		m := &goqite.Message{
-			Body: []byte("yo"),
+func TestSetup(t *testing.T) {
+	t.Run("creates the database table", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", ":memory:?_journal=WAL&_timeout=5000&_fk=true")
+		if err != nil {
+			t.Fatal(err)
 		}
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
 
-		err := q.Send(context.Background(), *m)
+		_, err = db.Exec(`select * from goqite`)
+		is.Equal(t, "no such table: goqite", err.Error())
+		err = goqite.Setup(context.Background(), db)
+		is.NotError(t, err)
+		_, err = db.Exec(`select * from goqite`)
 		is.NotError(t, err)
+	})
 
-		m, err = q.Receive(context.Background())
+	t.Run("migrates an existing schema without data loss", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
 		is.NotError(t, err)
-		is.NotNil(t, m)
-		is.Equal(t, "yo", string(m.Body))
 
-		m, err = q.Receive(context.Background())
+		err = goqite.Setup(context.Background(), db)
 		is.NotError(t, err)
-		is.Nil(t, m)
+
+		var version int
+		err = db.QueryRow(`select max(version) from goqite_migrations`).Scan(&version)
+		is.NotError(t, err)
+		is.True(t, version >= 1)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, "yo", string(m.Body))
 	})
 
-	t.Run("does receive a message up to two times if set and timeout has passed", func(t *testing.T) {
-		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond, MaxReceive: 2}, ":memory:")
+	t.Run("migrates a schema from the first version", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		_, err := db.Exec(`drop table goqite`)
+		is.NotError(t, err)
+		_, err = db.Exec(schemaV1)
+		is.NotError(t, err)
 
-		m := &goqite.Message{
-			Body: []byte("yo"),
-		}
+		_, err = db.Exec(`insert into goqite (queue, body) values ('test', x'796f')`)
+		is.NotError(t, err)
 
-		err := q.Send(context.Background(), *m)
+		err = goqite.Setup(context.Background(), db)
 		is.NotError(t, err)
 
-		m, err = q.Receive(context.Background())
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		_, created, err := q.SendIdempotent(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
 		is.NotError(t, err)
-		is.NotNil(t, m)
-		is.Equal(t, "yo", string(m.Body))
+		is.True(t, created)
 
-		time.Sleep(time.Millisecond)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Error(t, goqite.ErrDuplicate, err)
 
-		m, err = q.Receive(context.Background())
+		var count int
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
 		is.NotError(t, err)
-		is.NotNil(t, m)
-		is.Equal(t, "yo", string(m.Body))
+		is.Equal(t, 2, count)
 
-		time.Sleep(time.Millisecond)
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 2, n)
 
-		m, err = q.Receive(context.Background())
+		m, err := q.Receive(context.Background())
 		is.NotError(t, err)
-		is.Nil(t, m)
+		is.NotNil(t, m)
+		is.Equal(t, "", m.Producer)
 	})
 
-	t.Run("does not receive a message from a different queue", func(t *testing.T) {
-		q1 := newQ(t, goqite.NewOpts{}, "test.db")
-		q2 := newQ(t, goqite.NewOpts{Name: "q2"}, "test.db")
+	t.Run("does not count tombstones in the queue length of a schema without a recorded version", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+		q := goqite.New(goqite.NewOpts{DB: db, MaxDepth: 2, Name: "test", Tombstone: true})
 
-		err := q1.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		err = q.Delete(context.Background(), m.ID)
 		is.NotError(t, err)
 
-		m, err := q2.Receive(context.Background())
+		err = goqite.Setup(context.Background(), db)
 		is.NotError(t, err)
-		is.Nil(t, m)
-	})
-}
 
-func TestQueue_SendAndGetID(t *testing.T) {
-	t.Run("returns the message ID", func(t *testing.T) {
-		q := newQ(t, goqite.NewOpts{}, ":memory:")
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
 
-		m := goqite.Message{
-			Body: []byte("yo"),
+		for i := 0; i < 2; i++ {
+			err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
 		}
+	})
 
-		id, err := q.SendAndGetID(context.Background(), m)
+	t.Run("is idempotent", func(t *testing.T) {
+		db := newDB(t, ":memory:")
+
+		err := goqite.Setup(context.Background(), db)
+		is.NotError(t, err)
+		err = goqite.Setup(context.Background(), db)
 		is.NotError(t, err)
-		is.Equal(t, 34, len(id))
 
-		err = q.Delete(context.Background(), id)
+		var count int
+		err = db.QueryRow(`select count(*) from goqite_migrations`).Scan(&count)
 		is.NotError(t, err)
+		is.Equal(t, 1, count)
 	})
 }
 
-func TestQueue_Extend(t *testing.T) {
-	t.Run("does not receive a message that has had the timeout extended", func(t *testing.T) {
-		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+func TestQueue_Close(t *testing.T) {
+	t.Run("closes the cached prepared statements", func(t *testing.T) {
+		c := &stmtConnector{}
+		db := sql.OpenDB(c)
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		_, err := db.Exec(schema)
+		is.NotError(t, err)
 
-		m := &goqite.Message{
-			Body: []byte("yo"),
+		q := goqite.New(goqite.NewOpts{DB: db, Name: "test"})
+
+		// The first round runs the queries unprepared and caches them, the second round uses the cached statements
+		for i := 0; i < 2; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			is.NotNil(t, m)
+
+			err = q.Delete(context.Background(), m.ID)
+			is.NotError(t, err)
 		}
 
-		err := q.Send(context.Background(), *m)
-		is.NotError(t, err)
+		is.True(t, c.open.Load() > 0)
 
-		m, err = q.Receive(context.Background())
+		err = q.Close()
 		is.NotError(t, err)
-		is.NotNil(t, m)
+		is.Equal(t, int32(0), c.open.Load())
 
-		err = q.Extend(context.Background(), m.ID, time.Second)
+		err = q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
 		is.NotError(t, err)
 
-		time.Sleep(time.Millisecond)
-
-		m, err = q.Receive(context.Background())
+		m, err := q.Receive(context.Background())
 		is.NotError(t, err)
-		is.Nil(t, m)
+		is.NotNil(t, m)
+		is.Equal(t, int32(0), c.open.Load())
 	})
 
-	t.Run("panics if delay is negative", func(t *testing.T) {
+	t.Run("can be closed while the queue is in use", func(t *testing.T) {
 		q := newQ(t, goqite.NewOpts{}, ":memory:")
 
-		var err error
-		defer func() {
-			is.NotError(t, err)
-			r := recover()
-			is.Equal(t, "delay cannot be negative", r)
-		}()
-
-		m := &goqite.Message{
-			Body: []byte("yo"),
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+					is.NotError(t, err)
+
+					m, err := q.Receive(context.Background())
+					is.NotError(t, err)
+					is.NotNil(t, m)
+
+					err = q.Delete(context.Background(), m.ID)
+					is.NotError(t, err)
+				}
+			}()
 		}
 
-		err = q.Send(context.Background(), *m)
-		is.NotError(t, err)
-
-		m, err = q.Receive(context.Background())
+		time.Sleep(time.Millisecond)
+		err := q.Close()
 		is.NotError(t, err)
-		is.NotNil(t, m)
-
-		err = q.Extend(context.Background(), m.ID, -1)
+		wg.Wait()
 	})
 }
 
-func TestQueue_ReceiveAndWait(t *testing.T) {
-	t.Run("waits for a message until the context is cancelled", func(t *testing.T) {
-		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+func TestQueue_SendTx(t *testing.T) {
+	t.Run("works with a transaction on another database handle after the queue has cached statements", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.db")
+		q := newQ(t, goqite.NewOpts{}, path)
+		otherDB := newDB(t, path)
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
-		defer cancel()
+		// Cache the statements of the queue
+		for i := 0; i < 2; i++ {
+			err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
+			m, err := q.Receive(context.Background())
+			is.NotError(t, err)
+			err = q.Delete(context.Background(), m.ID)
+			is.NotError(t, err)
+		}
 
-		m, err := q.ReceiveAndWait(ctx, time.Millisecond)
-		is.Error(t, context.DeadlineExceeded, err)
-		is.Nil(t, m)
-	})
+		for i := 0; i < 2; i++ {
+			tx, err := otherDB.Begin()
+			is.NotError(t, err)
 
-	t.Run("gets a message immediately if there is one", func(t *testing.T) {
-		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+			err = q.SendTx(context.Background(), tx, goqite.Message{Body: []byte("yo")})
+			is.NotError(t, err)
 
-		err := q.Send(context.Background(), goqite.Message{Body: []byte("yo")})
-		is.NotError(t, err)
+			m, err := q.ReceiveTx(context.Background(), tx)
+			is.NotError(t, err)
+			is.NotNil(t, m)
 
-		m, err := q.ReceiveAndWait(context.Background(), time.Millisecond)
-		is.NotError(t, err)
-		is.NotNil(t, m)
-		is.Equal(t, "yo", string(m.Body))
-	})
-}
+			err = q.DeleteTx(context.Background(), tx, m.ID)
+			is.NotError(t, err)
 
-func TestSetup(t *testing.T) {
-	t.Run("creates the database table", func(t *testing.T) {
-		db, err := sql.Open("sqlite3", ":memory:?_journal=WAL&_timeout=5000&_fk=true")
-		if err != nil {
-			t.Fatal(err)
+			err = tx.Commit()
+			is.NotError(t, err)
 		}
-		db.SetMaxOpenConns(1)
-		db.SetMaxIdleConns(1)
-
-		_, err = db.Exec(`select * from goqite`)
-		is.Equal(t, "no such table: goqite", err.Error())
-		err = goqite.Setup(context.Background(), db)
-		is.NotError(t, err)
-		_, err = db.Exec(`select * from goqite`)
-		is.NotError(t, err)
 	})
 }
 
@@ -322,6 +3439,30 @@ func BenchmarkQueue(b *testing.B) {
 		})
 	})
 
+	b.Run("send, receive, delete with and without the single consumer hint", func(b *testing.B) {
+		for _, singleConsumer := range []bool{false, true} {
+			b.Run(fmt.Sprintf("single consumer %v", singleConsumer), func(b *testing.B) {
+				q := newQ(b, goqite.NewOpts{SingleConsumer: singleConsumer}, "bench.db")
+
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					err := q.Send(context.Background(), goqite.Message{
+						Body: []byte("yo"),
+					})
+					is.NotError(b, err)
+
+					m, err := q.Receive(context.Background())
+					is.NotError(b, err)
+					is.NotNil(b, m)
+
+					err = q.Delete(context.Background(), m.ID)
+					is.NotError(b, err)
+				}
+			})
+		}
+	})
+
 	b.Run("receive and delete message on a big table with multiple queues", func(b *testing.B) {
 		indexes := []struct {
 			query string
@@ -413,6 +3554,119 @@ func newDB(t testing.TB, path string) *sql.DB {
 	return db
 }
 
+type testLogger func(msg string, args ...any)
+
+func (f testLogger) Info(msg string, args ...any) {
+	f(msg, args...)
+}
+
+// busyConnector wraps the SQLite driver and returns a busy error from the first busy calls to begin a transaction.
+type busyConnector struct {
+	busy int
+}
+
+func (c *busyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(":memory:?_journal=WAL&_timeout=5000&_fk=true")
+	if err != nil {
+		return nil, err
+	}
+	return &busyConn{Conn: conn, c: c}, nil
+}
+
+func (c *busyConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+type busyConn struct {
+	driver.Conn
+	c *busyConnector
+}
+
+func (c *busyConn) Begin() (driver.Tx, error) {
+	if c.c.busy > 0 {
+		c.c.busy--
+		return nil, errors.New("database is locked")
+	}
+	return c.Conn.Begin() //nolint:staticcheck
+}
+
+func (c *busyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+// stmtConnector wraps the SQLite driver and counts the open prepared statements.
+// Queries not run as prepared statements are passed through without counting.
+type stmtConnector struct {
+	open atomic.Int32
+}
+
+func (c *stmtConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(":memory:?_fk=true")
+	if err != nil {
+		return nil, err
+	}
+	return &stmtConn{Conn: conn, c: c}, nil
+}
+
+func (c *stmtConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+type stmtConn struct {
+	driver.Conn
+	c *stmtConnector
+}
+
+func (c *stmtConn) Prepare(query string) (driver.Stmt, error) {
+	s, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.c.open.Add(1)
+	return &stmt{Stmt: s, c: c.c}, nil
+}
+
+func (c *stmtConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *stmtConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+type stmt struct {
+	driver.Stmt
+	c *stmtConnector
+}
+
+func (s *stmt) Close() error {
+	s.c.open.Add(-1)
+	return s.Stmt.Close()
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+func newBusyDB(t testing.TB, busy int) (*sql.DB, *busyConnector) {
+	t.Helper()
+
+	c := &busyConnector{busy: busy}
+	db := sql.OpenDB(c)
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, c
+}
+
 func newQ(t testing.TB, opts goqite.NewOpts, path string) *goqite.Queue {
 	t.Helper()
 
@@ -1,37 +1,123 @@
 // Package http provides an HTTP handler for a goqite.Queue.
 // GET receives a message from the queue, if any. If there is no message, it returns a 204 No Content.
-// POST sends a message to the queue.
-// PUT extends a message's timeout.
+// POST sends a message to the queue, and responds with the ID of the sent message, like {"ID":"m_123"}.
+// PUT extends a message's timeout, by the message delay, or to the absolute message timeout if there is no delay.
+// PUT with ?action=nack signals that processing a message failed, making it receivable again after the given delay,
+// or immediately if there is no delay.
 // DELETE deletes a message from the queue.
+//
+// To keep a message from being redelivered while processing it for longer than the message timeout,
+// send a PUT with the message ID and a delay periodically, before the previous timeout runs out.
+// [Heartbeat] does this for you.
+//
+// Messages are sent and received as JSON, by default wrapped in an envelope. See [Format] for the alternatives.
+// In the JSON formats, the message body is a base64-encoded string, because it is a []byte.
+// Use [FormatRaw] to send and receive the body bytes directly.
 package http
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/maragudk/goqite"
 )
 
 type queue interface {
-	Send(ctx context.Context, m goqite.Message) error
-	Receive(ctx context.Context) (*goqite.Message, error)
+	SendAndGetID(ctx context.Context, m goqite.Message) (goqite.ID, error)
+	Receive(ctx context.Context, opts ...goqite.ReceiveOption) (*goqite.Message, error)
 	ReceiveAndWait(ctx context.Context, interval time.Duration) (*goqite.Message, error)
 	Extend(ctx context.Context, id goqite.ID, delay time.Duration) error
+	ExtendUntil(ctx context.Context, id goqite.ID, t time.Time) error
+	Nack(ctx context.Context, id goqite.ID) error
 	Delete(ctx context.Context, id goqite.ID) error
 }
 
 type request struct {
-	Message goqite.Message
+	Message envelopeMessage
 }
 
 type response struct {
-	Message *goqite.Message
+	Message *envelopeMessage
 }
 
+// sendResponse is the response to a POST request in [FormatEnvelope].
+type sendResponse struct {
+	ID goqite.ID
+}
+
+// envelopeMessage is a [goqite.Message] in [FormatEnvelope]. Only the ID, delay, and body are always there,
+// like in the first version of the format, and the other fields are left out when empty.
+type envelopeMessage struct {
+	ID       goqite.ID
+	Delay    time.Duration
+	Body     []byte
+	DedupKey string     `json:",omitempty"`
+	Producer string     `json:",omitempty"`
+	Received int        `json:",omitempty"`
+	Timeout  *time.Time `json:",omitempty"`
+}
+
+// Format of the request and response bodies of the handler.
+type Format int
+
+const (
+	// FormatEnvelope wraps the message in an object with a Message field, using the Go field names of [goqite.Message],
+	// like {"Message":{"ID":"m_123","Delay":1000000000,"Body":"eW8="}}. This is the default.
+	FormatEnvelope Format = iota
+
+	// FormatFlat puts the message fields at the top level, with snake_case names, and the delay as a duration string,
+	// like {"id":"m_123","delay":"1s","body":"eW8="}. Empty fields are left out.
+	FormatFlat
+
+	// FormatRaw uses the request and response bodies as the message body as is, without JSON or base64 encoding.
+	// The message ID is in the Goqite-Message-Id header of GET and POST responses, and in the "id" query parameter
+	// of PUT and DELETE requests. The delay is in the "delay" query parameter, as a duration string,
+	// and the absolute timeout of PUT requests in the "timeout" query parameter, as an RFC 3339 timestamp.
+	FormatRaw
+)
+
+// MessageIDHeader is the response header with the message ID in [FormatRaw].
+const MessageIDHeader = "Goqite-Message-Id"
+
+type NewHandlerOpts struct {
+	Format Format
+	Log    logger
+}
+
+// NewHandler is like [NewHandlerWithOpts] with default options.
 func NewHandler(q queue) http.HandlerFunc {
+	return NewHandlerWithOpts(q, NewHandlerOpts{})
+}
+
+// NewHandlerWithOpts returns a handler for the queue q.
+// Queue errors that are likely transient, such as a missing schema, a lost database connection, or a full queue
+// ([goqite.ErrQueueFull]), result in a 503 Service Unavailable with a Retry-After header.
+// Messages rejected by the queue validation ([goqite.ValidationError]) result in a 400 Bad Request, and duplicate
+// messages ([goqite.ErrDuplicate]) in a 409 Conflict. Other queue errors result in a 500.
+// Every request failing with a queue error is logged to opts.Log, with the method and the error.
+func NewHandlerWithOpts(q queue, opts NewHandlerOpts) http.HandlerFunc {
+	if opts.Log == nil {
+		opts.Log = &discardLogger{}
+	}
+
+	fail := func(w http.ResponseWriter, r *http.Request, msg string, err error) {
+		code := statusCode(err)
+		if code == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		opts.Log.Info("Error handling request", "method", r.Method, "code", code, "error", err)
+		http.Error(w, msg+": "+err.Error(), code)
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
@@ -78,7 +164,7 @@ func NewHandler(q queue) http.HandlerFunc {
 			}
 
 			if err != nil {
-				http.Error(w, "error receiving message: "+err.Error(), http.StatusInternalServerError)
+				fail(w, r, "error receiving message", err)
 				return
 			}
 
@@ -87,72 +173,296 @@ func NewHandler(q queue) http.HandlerFunc {
 				return
 			}
 
-			if err := json.NewEncoder(w).Encode(response{Message: m}); err != nil {
-				http.Error(w, "error encoding message: "+err.Error(), http.StatusInternalServerError)
+			if err := encodeMessage(w, m, opts.Format); err != nil {
+				fail(w, r, "error encoding message", err)
 				return
 			}
 
 		case http.MethodPost:
-			req, ok := fromJson(w, r)
+			m, ok := decodeMessage(w, r, opts.Format)
 			if !ok {
 				return
 			}
 
-			if req.Message.Delay < 0 {
+			if m.Delay < 0 {
 				http.Error(w, "delay cannot be negative", http.StatusBadRequest)
 				return
 			}
 
-			if err := q.Send(r.Context(), req.Message); err != nil {
-				http.Error(w, "error sending message: "+err.Error(), http.StatusInternalServerError)
+			id, err := q.SendAndGetID(r.Context(), m)
+			if err != nil {
+				fail(w, r, "error sending message", err)
+				return
+			}
+
+			if opts.Format == FormatEnvelope {
+				if err := json.NewEncoder(w).Encode(sendResponse{ID: id}); err != nil {
+					fail(w, r, "error encoding response", err)
+				}
+				return
+			}
+
+			if err := encodeMessage(w, &goqite.Message{ID: id}, opts.Format); err != nil {
+				fail(w, r, "error encoding message", err)
 				return
 			}
 
 		case http.MethodPut:
-			req, ok := fromJson(w, r)
+			m, ok := decodeMessage(w, r, opts.Format)
 			if !ok {
 				return
 			}
 
-			if req.Message.ID == "" {
+			if m.ID == "" {
 				http.Error(w, "ID cannot be empty", http.StatusBadRequest)
 				return
 			}
-			if req.Message.Delay <= 0 {
+
+			switch r.URL.Query().Get("action") {
+			case "":
+			case "nack":
+				if m.Delay < 0 {
+					http.Error(w, "delay cannot be negative", http.StatusBadRequest)
+					return
+				}
+
+				var err error
+				if m.Delay == 0 {
+					err = q.Nack(r.Context(), m.ID)
+				} else {
+					err = q.Extend(r.Context(), m.ID, m.Delay)
+				}
+				if err != nil {
+					fail(w, r, "error nacking message", err)
+				}
+				return
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+				return
+			}
+
+			// The delay takes precedence, so a received message, which has a timeout, can be sent back with a delay
+			if m.Delay == 0 && !m.Timeout.IsZero() {
+				if !m.Timeout.After(time.Now()) {
+					http.Error(w, "timeout must be in the future", http.StatusBadRequest)
+					return
+				}
+
+				if err := q.ExtendUntil(r.Context(), m.ID, m.Timeout); err != nil {
+					fail(w, r, "error extending message", err)
+				}
+				return
+			}
+
+			if m.Delay <= 0 {
 				http.Error(w, "delay must larger than zero", http.StatusBadRequest)
 				return
 			}
 
-			err := q.Extend(r.Context(), req.Message.ID, req.Message.Delay)
+			err := q.Extend(r.Context(), m.ID, m.Delay)
 			if err != nil {
-				http.Error(w, "error extending message: "+err.Error(), http.StatusInternalServerError)
+				fail(w, r, "error extending message", err)
 				return
 			}
 
 		case http.MethodDelete:
-			req, ok := fromJson(w, r)
+			m, ok := decodeMessage(w, r, opts.Format)
 			if !ok {
 				return
 			}
 
-			if req.Message.ID == "" {
+			if m.ID == "" {
 				http.Error(w, "ID cannot be empty", http.StatusBadRequest)
 				return
 			}
 
-			if err := q.Delete(r.Context(), req.Message.ID); err != nil {
-				http.Error(w, "error deleting message: "+err.Error(), http.StatusInternalServerError)
+			if err := q.Delete(r.Context(), m.ID); err != nil {
+				fail(w, r, "error deleting message", err)
 				return
 			}
 		}
 	}
 }
 
-func fromJson(w http.ResponseWriter, r *http.Request) (request, bool) {
+// statusCode for the queue error err.
+func statusCode(err error) int {
+	var validationErr *goqite.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest
+	case errors.Is(err, goqite.ErrDuplicate):
+		return http.StatusConflict
+	case errors.Is(err, goqite.ErrQueueFull), isUnavailable(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// isUnavailable reports whether err means the queue is temporarily unavailable,
+// so the request can be retried later.
+func isUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "no such table") || strings.Contains(msg, "database is locked")
+}
+
+// flatMessage is a [goqite.Message] in [FormatFlat].
+type flatMessage struct {
+	ID       goqite.ID  `json:"id,omitempty"`
+	Delay    string     `json:"delay,omitempty"`
+	Body     []byte     `json:"body,omitempty"`
+	DedupKey string     `json:"dedup_key,omitempty"`
+	Producer string     `json:"producer,omitempty"`
+	Received int        `json:"received,omitempty"`
+	Timeout  *time.Time `json:"timeout,omitempty"`
+}
+
+func decodeMessage(w http.ResponseWriter, r *http.Request, format Format) (goqite.Message, bool) {
+	if format == FormatRaw {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "error reading request: "+err.Error(), http.StatusBadRequest)
+			return goqite.Message{}, false
+		}
+
+		m := goqite.Message{ID: goqite.ID(r.URL.Query().Get("id")), Body: body}
+		if delay := r.URL.Query().Get("delay"); delay != "" {
+			if m.Delay, err = time.ParseDuration(delay); err != nil {
+				http.Error(w, "error parsing delay parameter: "+err.Error(), http.StatusBadRequest)
+				return goqite.Message{}, false
+			}
+		}
+		if timeout := r.URL.Query().Get("timeout"); timeout != "" {
+			if m.Timeout, err = time.Parse(time.RFC3339Nano, timeout); err != nil {
+				http.Error(w, "error parsing timeout parameter: "+err.Error(), http.StatusBadRequest)
+				return goqite.Message{}, false
+			}
+		}
+		return m, true
+	}
+
+	if format == FormatFlat {
+		var fm flatMessage
+		if err := json.NewDecoder(r.Body).Decode(&fm); err != nil {
+			http.Error(w, "error decoding request: "+err.Error(), http.StatusBadRequest)
+			return goqite.Message{}, false
+		}
+
+		m := goqite.Message{ID: fm.ID, Body: fm.Body, DedupKey: fm.DedupKey}
+		if fm.Delay != "" {
+			var err error
+			if m.Delay, err = time.ParseDuration(fm.Delay); err != nil {
+				http.Error(w, "error parsing delay: "+err.Error(), http.StatusBadRequest)
+				return goqite.Message{}, false
+			}
+		}
+		if fm.Timeout != nil {
+			m.Timeout = *fm.Timeout
+		}
+		return m, true
+	}
+
 	var req request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "error decoding request: "+err.Error(), http.StatusBadRequest)
-		return req, false
+		return goqite.Message{}, false
+	}
+
+	em := req.Message
+	m := goqite.Message{ID: em.ID, Delay: em.Delay, Body: em.Body, DedupKey: em.DedupKey}
+	if em.Timeout != nil {
+		m.Timeout = *em.Timeout
+	}
+	return m, true
+}
+
+func encodeMessage(w http.ResponseWriter, m *goqite.Message, format Format) error {
+	if format == FormatRaw {
+		w.Header().Set(MessageIDHeader, string(m.ID))
+		if len(m.Body) == 0 {
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err := w.Write(m.Body)
+		return err
+	}
+
+	if format == FormatFlat {
+		fm := flatMessage{ID: m.ID, Body: m.Body, DedupKey: m.DedupKey, Producer: m.Producer, Received: m.Received}
+		if m.Delay != 0 {
+			fm.Delay = m.Delay.String()
+		}
+		if !m.Timeout.IsZero() {
+			fm.Timeout = &m.Timeout
+		}
+		return json.NewEncoder(w).Encode(fm)
+	}
+
+	em := envelopeMessage{ID: m.ID, Delay: m.Delay, Body: m.Body, DedupKey: m.DedupKey, Producer: m.Producer,
+		Received: m.Received}
+	if !m.Timeout.IsZero() {
+		em.Timeout = &m.Timeout
+	}
+	return json.NewEncoder(w).Encode(response{Message: &em})
+}
+
+// Heartbeat extends the message with the given id by delay every interval, by sending PUT requests to the handler
+// at url using the client c. It blocks until the context is cancelled, after which it returns nil.
+// If an extension fails, the error is returned, and the message may be redelivered after its timeout.
+// The interval should be well below the delay, to account for network latency.
+// The handler must use [FormatEnvelope].
+func Heartbeat(ctx context.Context, c *http.Client, url string, id goqite.ID, delay, interval time.Duration) error {
+	if delay <= 0 {
+		panic("delay must be larger than zero")
+	}
+
+	if interval <= 0 || interval >= delay {
+		panic("interval must be between 0 (exclusive) and delay (exclusive)")
+	}
+
+	body, err := json.Marshal(request{Message: envelopeMessage{ID: id, Delay: delay}})
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+
+			res, err := c.Do(req)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			resBody, _ := io.ReadAll(res.Body)
+			_ = res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("error extending message, got status %v: %s", res.StatusCode, bytes.TrimSpace(resBody))
+			}
+		}
 	}
-	return req, true
 }
+
+// logger matches the info level method from the slog.Logger.
+type logger interface {
+	Info(msg string, args ...any)
+}
+
+type discardLogger struct{}
+
+func (d *discardLogger) Info(msg string, args ...any) {}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -29,11 +31,11 @@ type queueMock struct {
 	err error
 }
 
-func (q *queueMock) Send(ctx context.Context, m goqite.Message) error {
-	return q.err
+func (q *queueMock) SendAndGetID(ctx context.Context, m goqite.Message) (goqite.ID, error) {
+	return "", q.err
 }
 
-func (q *queueMock) Receive(ctx context.Context) (*goqite.Message, error) {
+func (q *queueMock) Receive(ctx context.Context, opts ...goqite.ReceiveOption) (*goqite.Message, error) {
 	return nil, q.err
 }
 
@@ -45,10 +47,18 @@ func (q *queueMock) Extend(ctx context.Context, id goqite.ID, delay time.Duratio
 	return q.err
 }
 
+func (q *queueMock) ExtendUntil(ctx context.Context, id goqite.ID, t time.Time) error {
+	return q.err
+}
+
 func (q *queueMock) Delete(ctx context.Context, id goqite.ID) error {
 	return q.err
 }
 
+func (q *queueMock) Nack(ctx context.Context, id goqite.ID) error {
+	return q.err
+}
+
 func TestNewHandler(t *testing.T) {
 	t.Run("errors if cannot decode request", func(t *testing.T) {
 		q := &queueMock{}
@@ -66,6 +76,193 @@ func TestNewHandler(t *testing.T) {
 	})
 }
 
+func TestNewHandlerWithOpts(t *testing.T) {
+	t.Run("responds with 503 and Retry-After if the queue is unavailable", func(t *testing.T) {
+		for _, err := range []error{driver.ErrBadConn, sql.ErrConnDone, errors.New("no such table: goqite")} {
+			t.Run(err.Error(), func(t *testing.T) {
+				h := qhttp.NewHandlerWithOpts(&queueMock{err: err}, qhttp.NewHandlerOpts{})
+
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				w := httptest.NewRecorder()
+				h(w, r)
+
+				is.Equal(t, http.StatusServiceUnavailable, w.Code)
+				is.Equal(t, "1", w.Header().Get("Retry-After"))
+			})
+		}
+	})
+
+	t.Run("responds with 503 and Retry-After if the queue is full", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{MaxDepth: 1})
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusOK, code)
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"Message":{"Body":"eW8="}}`))
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		is.Equal(t, http.StatusServiceUnavailable, w.Code)
+		is.Equal(t, "1", w.Header().Get("Retry-After"))
+	})
+
+	t.Run("responds with 400 if the message fails validation", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Validate: func(m goqite.Message) error {
+			if len(m.Body) == 0 {
+				return errors.New("body cannot be empty")
+			}
+			return nil
+		}})
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{})
+		is.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("responds with 409 if the message is a duplicate", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{})
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, _ = newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo"), DedupKey: "a"})
+		is.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("responds with 500 and no Retry-After on unexpected errors", func(t *testing.T) {
+		h := qhttp.NewHandlerWithOpts(&queueMock{err: errors.New("oh no")}, qhttp.NewHandlerOpts{})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusInternalServerError, code)
+	})
+
+	t.Run("logs failing requests with method and error", func(t *testing.T) {
+		var log logMock
+		h := qhttp.NewHandlerWithOpts(&queueMock{err: driver.ErrBadConn}, qhttp.NewHandlerOpts{Log: &log})
+
+		code, _, _ := newRequest(t, h, http.MethodDelete, &goqite.Message{ID: "m_123"})
+		is.Equal(t, http.StatusServiceUnavailable, code)
+		is.True(t, strings.Contains(log.String(), "method=DELETE"))
+		is.True(t, strings.Contains(log.String(), "error="+driver.ErrBadConn.Error()))
+	})
+}
+
+func TestNewHandlerWithOpts_FormatFlat(t *testing.T) {
+	t.Run("sends, receives, extends, and deletes flat messages with snake_case fields", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Producer: "test"})
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{Format: qhttp.FormatFlat})
+
+		do := func(method, body string) (int, map[string]any) {
+			t.Helper()
+			r := httptest.NewRequest(method, "/", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h(w, r)
+			var res map[string]any
+			_ = json.Unmarshal(w.Body.Bytes(), &res)
+			return w.Code, res
+		}
+
+		code, res := do(http.MethodPost, `{"body":"eW8=","dedup_key":"a"}`)
+		is.Equal(t, http.StatusOK, code)
+		id, ok := res["id"].(string)
+		is.True(t, ok)
+		is.True(t, strings.HasPrefix(id, "m_"))
+		is.Equal(t, 1, len(res))
+
+		code, res = do(http.MethodGet, "")
+		is.Equal(t, http.StatusOK, code)
+		is.Equal[any](t, id, res["id"])
+		is.Equal[any](t, "eW8=", res["body"])
+		is.Equal[any](t, "test", res["producer"])
+		is.Equal[any](t, float64(1), res["received"])
+		_, ok = res["timeout"].(string)
+		is.True(t, ok)
+		_, ok = res["Message"]
+		is.True(t, !ok)
+
+		code, _ = do(http.MethodPut, `{"id":"`+id+`","delay":"1m"}`)
+		is.Equal(t, http.StatusOK, code)
+
+		code, _ = do(http.MethodDelete, `{"id":"`+id+`"}`)
+		is.Equal(t, http.StatusOK, code)
+
+		code, _ = do(http.MethodGet, "")
+		is.Equal(t, http.StatusNoContent, code)
+	})
+
+	t.Run("errors on an invalid delay", func(t *testing.T) {
+		h := qhttp.NewHandlerWithOpts(&queueMock{}, qhttp.NewHandlerOpts{Format: qhttp.FormatFlat})
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"body":"eW8=","delay":"soon"}`))
+		w := httptest.NewRecorder()
+		h(w, r)
+		is.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestNewHandlerWithOpts_FormatRaw(t *testing.T) {
+	t.Run("sends, receives, extends, and deletes raw message bodies", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{})
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{Format: qhttp.FormatRaw})
+
+		do := func(method, target string, body []byte) *httptest.ResponseRecorder {
+			t.Helper()
+			r := httptest.NewRequest(method, target, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h(w, r)
+			return w
+		}
+
+		body := []byte{0x00, 0xff, 'y', 'o', '\n'}
+
+		w := do(http.MethodPost, "/", body)
+		is.Equal(t, http.StatusOK, w.Code)
+		id := w.Header().Get(qhttp.MessageIDHeader)
+		is.True(t, strings.HasPrefix(id, "m_"))
+		is.Equal(t, 0, w.Body.Len())
+
+		w = do(http.MethodGet, "/", nil)
+		is.Equal(t, http.StatusOK, w.Code)
+		is.Equal(t, id, w.Header().Get(qhttp.MessageIDHeader))
+		is.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+		is.True(t, bytes.Equal(body, w.Body.Bytes()))
+
+		w = do(http.MethodPut, "/?id="+id+"&delay=1m", nil)
+		is.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodDelete, "/?id="+id, nil)
+		is.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodGet, "/", nil)
+		is.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("sends with a delay from the query", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{})
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{Format: qhttp.FormatRaw})
+
+		r := httptest.NewRequest(http.MethodPost, "/?delay=1m", strings.NewReader("yo"))
+		w := httptest.NewRecorder()
+		h(w, r)
+		is.Equal(t, http.StatusOK, w.Code)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("errors on an invalid delay", func(t *testing.T) {
+		h := qhttp.NewHandlerWithOpts(&queueMock{}, qhttp.NewHandlerOpts{Format: qhttp.FormatRaw})
+
+		r := httptest.NewRequest(http.MethodPost, "/?delay=soon", strings.NewReader("yo"))
+		w := httptest.NewRecorder()
+		h(w, r)
+		is.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
 func TestNewHandler_Get(t *testing.T) {
 	t.Run("receives nothing if there is no message", func(t *testing.T) {
 		h := newH(t, goqite.NewOpts{})
@@ -120,6 +317,28 @@ func TestNewHandler_Get(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("leaves out empty fields that are not in the first version of the envelope", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{})
+		h := qhttp.NewHandler(q)
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		code, body, _ := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+
+		var res map[string]map[string]any
+		err = json.Unmarshal([]byte(body), &res)
+		is.NotError(t, err)
+		is.Equal[any](t, string(id), res["Message"]["ID"])
+		is.Equal[any](t, float64(1), res["Message"]["Received"])
+		is.True(t, res["Message"]["Timeout"] != nil)
+		for _, field := range []string{"DedupKey", "Producer", "Created"} {
+			_, ok := res["Message"][field]
+			is.True(t, !ok)
+		}
+	})
 }
 
 func TestNewHandler_Post(t *testing.T) {
@@ -130,11 +349,16 @@ func TestNewHandler_Post(t *testing.T) {
 			Body: []byte("yo"),
 		})
 		is.Equal(t, http.StatusOK, code)
-		is.Equal(t, "", body)
+		var sent struct{ ID goqite.ID }
+		err := json.Unmarshal([]byte(body), &sent)
+		is.NotError(t, err)
+		is.True(t, strings.HasPrefix(string(sent.ID), "m_"))
+		is.Equal(t, `{"ID":"`+string(sent.ID)+`"}`, body)
 
 		code, _, res := newRequest(t, h, http.MethodGet, nil)
 		is.Equal(t, http.StatusOK, code)
 		is.Equal(t, "yo", string(res.Message.Body))
+		is.Equal(t, sent.ID, res.Message.ID)
 	})
 
 	t.Run("errors if delay is negative", func(t *testing.T) {
@@ -216,6 +440,211 @@ func TestNewHandler_Put(t *testing.T) {
 	})
 }
 
+func TestNewHandler_Put_Timeout(t *testing.T) {
+	t.Run("can extend a message timeout to an absolute time", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{Timeout: time.Millisecond})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, res := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, _ = newRequest(t, h, http.MethodPut, &goqite.Message{
+			ID:      res.Message.ID,
+			Timeout: time.Now().Add(50 * time.Millisecond),
+		})
+		is.Equal(t, http.StatusOK, code)
+
+		time.Sleep(5 * time.Millisecond)
+
+		code, _, _ = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusNoContent, code)
+
+		time.Sleep(50 * time.Millisecond)
+
+		code, _, res = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+		is.Equal(t, "yo", string(res.Message.Body))
+	})
+
+	t.Run("uses the delay if both delay and timeout are given", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{Timeout: time.Millisecond})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, res := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+
+		m := res.Message
+		m.Delay = time.Minute
+		code, _, _ = newRequest(t, h, http.MethodPut, &m)
+		is.Equal(t, http.StatusOK, code)
+
+		time.Sleep(2 * time.Millisecond)
+
+		code, _, _ = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusNoContent, code)
+	})
+
+	t.Run("can extend to an absolute time in the flat and raw formats", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond})
+		timeout := time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{Format: qhttp.FormatFlat})
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"id":"`+string(id)+`","timeout":"`+timeout+`"}`))
+		w := httptest.NewRecorder()
+		h(w, r)
+		is.Equal(t, http.StatusOK, w.Code)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		id, err = q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		h = qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{Format: qhttp.FormatRaw})
+		r = httptest.NewRequest(http.MethodPut, "/?id="+string(id)+"&timeout="+timeout, nil)
+		w = httptest.NewRecorder()
+		h(w, r)
+		is.Equal(t, http.StatusOK, w.Code)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("can extend to an absolute time with a zone offset", func(t *testing.T) {
+		q := newQ(t, goqite.NewOpts{Timeout: time.Millisecond})
+
+		id, err := q.SendAndGetID(context.Background(), goqite.Message{Body: []byte("yo")})
+		is.NotError(t, err)
+
+		// An offset five hours from the local one, like +05:00 with a UTC local zone
+		_, offset := time.Now().Zone()
+		until := time.Now().Add(50 * time.Millisecond).In(time.FixedZone("", offset+5*60*60))
+		timeout := until.Format(time.RFC3339Nano)
+
+		h := qhttp.NewHandlerWithOpts(q, qhttp.NewHandlerOpts{Format: qhttp.FormatFlat})
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"id":"`+string(id)+`","timeout":"`+timeout+`"}`))
+		w := httptest.NewRecorder()
+		h(w, r)
+		is.Equal(t, http.StatusOK, w.Code)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+
+		time.Sleep(time.Until(until) + time.Millisecond)
+
+		m, err = q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+		is.Equal(t, id, m.ID)
+	})
+
+	t.Run("errors if the timeout is not in the future", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{})
+
+		code, body, _ := newRequest(t, h, http.MethodPut, &goqite.Message{
+			ID:      "1",
+			Timeout: time.Now().Add(-time.Second),
+		})
+		is.Equal(t, http.StatusBadRequest, code)
+		is.Equal(t, "timeout must be in the future", body)
+	})
+
+	t.Run("errors if cannot extend in queue", func(t *testing.T) {
+		h := qhttp.NewHandler(&queueMock{err: errors.New("oh no")})
+
+		code, _, _ := newRequest(t, h, http.MethodPut, &goqite.Message{
+			ID:      "1",
+			Timeout: time.Now().Add(time.Minute),
+		})
+		is.Equal(t, http.StatusInternalServerError, code)
+	})
+}
+
+func TestNewHandler_Put_Nack(t *testing.T) {
+	nack := func(t *testing.T, h http.HandlerFunc, action string, m goqite.Message) (int, string) {
+		t.Helper()
+		b, err := json.Marshal(wrapper{m})
+		is.NotError(t, err)
+		r := httptest.NewRequest(http.MethodPut, "/?action="+action, bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	t.Run("makes a message receivable again right away without a delay", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{Timeout: time.Minute})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, res := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+
+		code, _ = nack(t, h, "nack", goqite.Message{ID: res.Message.ID})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, res = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+		is.Equal(t, "yo", string(res.Message.Body))
+		is.Equal(t, 2, res.Message.Received)
+	})
+
+	t.Run("makes a message receivable again after the delay", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{Timeout: time.Minute})
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, res := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+
+		code, _ = nack(t, h, "nack", goqite.Message{ID: res.Message.ID, Delay: 50 * time.Millisecond})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, _ = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusNoContent, code)
+
+		time.Sleep(50 * time.Millisecond)
+
+		code, _, res = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+		is.Equal(t, "yo", string(res.Message.Body))
+	})
+
+	t.Run("errors if delay is negative", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{})
+
+		code, body := nack(t, h, "nack", goqite.Message{ID: "1", Delay: -1})
+		is.Equal(t, http.StatusBadRequest, code)
+		is.Equal(t, "delay cannot be negative", body)
+	})
+
+	t.Run("errors if the action is unknown", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{})
+
+		code, body := nack(t, h, "ack", goqite.Message{ID: "1"})
+		is.Equal(t, http.StatusBadRequest, code)
+		is.Equal(t, "unknown action", body)
+	})
+
+	t.Run("errors if cannot nack in queue", func(t *testing.T) {
+		h := qhttp.NewHandler(&queueMock{err: errors.New("oh no")})
+
+		code, _ := nack(t, h, "nack", goqite.Message{ID: "1"})
+		is.Equal(t, http.StatusInternalServerError, code)
+	})
+}
+
 func TestNewHandler_Delete(t *testing.T) {
 	t.Run("deletes a message", func(t *testing.T) {
 		h := newH(t, goqite.NewOpts{})
@@ -255,6 +684,63 @@ func TestNewHandler_Delete(t *testing.T) {
 	})
 }
 
+func TestHeartbeat(t *testing.T) {
+	t.Run("extends the message while running", func(t *testing.T) {
+		h := newH(t, goqite.NewOpts{Timeout: 10 * time.Millisecond})
+		s := httptest.NewServer(h)
+		defer s.Close()
+
+		code, _, _ := newRequest(t, h, http.MethodPost, &goqite.Message{Body: []byte("yo")})
+		is.Equal(t, http.StatusOK, code)
+
+		code, _, res := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		done := make(chan error)
+		go func() {
+			done <- qhttp.Heartbeat(ctx, s.Client(), s.URL, res.Message.ID, 50*time.Millisecond, 10*time.Millisecond)
+		}()
+
+		// Well past the message timeout, but the heartbeat keeps extending it
+		time.Sleep(50 * time.Millisecond)
+		code, _, _ = newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusNoContent, code)
+
+		err := <-done
+		is.NotError(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+		code, _, res2 := newRequest(t, h, http.MethodGet, nil)
+		is.Equal(t, http.StatusOK, code)
+		is.Equal(t, res.Message.ID, res2.Message.ID)
+	})
+
+	t.Run("errors if the extension fails", func(t *testing.T) {
+		h := qhttp.NewHandler(&queueMock{err: errors.New("oh no")})
+		s := httptest.NewServer(h)
+		defer s.Close()
+
+		err := qhttp.Heartbeat(context.Background(), s.Client(), s.URL, "m_123", 50*time.Millisecond, time.Millisecond)
+		is.True(t, err != nil)
+		is.True(t, strings.Contains(err.Error(), "500"))
+	})
+}
+
+type logMock struct {
+	strings.Builder
+}
+
+func (l *logMock) Info(msg string, args ...any) {
+	l.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		_, _ = fmt.Fprintf(l, " %v=%v", args[i], args[i+1])
+	}
+	l.WriteString("\n")
+}
+
 func newRequest(t testing.TB, h http.HandlerFunc, method string, m *goqite.Message) (int, string, *wrapper) {
 	t.Helper()
 
@@ -3,9 +3,47 @@ package sql
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 )
 
-func InTx(db *sql.DB, cb func(*sql.Tx) error) (err error) {
+// RFC3339Milli is the timestamp format of the goqite schema. It's like time.RFC3339Nano, but with millisecond
+// precision, and fractional seconds do not have trailing zeros removed.
+const RFC3339Milli = "2006-01-02T15:04:05.000Z07:00"
+
+// InTxOpts are options for [InTxWithOpts].
+type InTxOpts struct {
+	BusyRetries    int           // How many times to retry the transaction if the database is busy.
+	BusyRetryDelay time.Duration // Delay before the first retry, doubled for each subsequent retry.
+	Log            logger        // Logs panics in the callback, before the transaction is rolled back and the panic re-raised.
+	Name           string        // Name of what the transaction is for, such as a queue, logged with panics if set.
+	Op             string        // Operation the transaction is for, logged with panics if set.
+}
+
+// logger matches the info level method from the slog.Logger.
+type logger interface {
+	Info(msg string, args ...any)
+}
+
+func InTx(db *sql.DB, cb func(*sql.Tx) error) error {
+	return InTxWithOpts(db, InTxOpts{}, cb)
+}
+
+// InTxWithOpts is like InTx, but retries the whole transaction with backoff if the database reports being busy
+// or locked. Other errors are returned immediately.
+func InTxWithOpts(db *sql.DB, opts InTxOpts, cb func(*sql.Tx) error) error {
+	delay := opts.BusyRetryDelay
+	for i := 0; ; i++ {
+		err := inTx(db, opts, cb)
+		if err == nil || i >= opts.BusyRetries || !isBusy(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func inTx(db *sql.DB, opts InTxOpts, cb func(*sql.Tx) error) (err error) {
 	tx, txErr := db.Begin()
 	if txErr != nil {
 		return fmt.Errorf("cannot start tx: %w", txErr)
@@ -14,6 +52,20 @@ func InTx(db *sql.DB, cb func(*sql.Tx) error) (err error) {
 	defer func() {
 		if rec := recover(); rec != nil {
 			err = rollback(tx, nil)
+			if opts.Log != nil {
+				var args []any
+				if opts.Name != "" {
+					args = append(args, "name", opts.Name)
+				}
+				if opts.Op != "" {
+					args = append(args, "op", opts.Op)
+				}
+				args = append(args, "error", rec)
+				if err != nil {
+					args = append(args, "rollbackError", err)
+				}
+				opts.Log.Info("Recovered from panic in transaction, rolled back and panicking again", args...)
+			}
 			panic(rec)
 		}
 	}()
@@ -35,3 +87,10 @@ func rollback(tx *sql.Tx, err error) error {
 	}
 	return err
 }
+
+// isBusy reports whether the error is SQLite's SQLITE_BUSY or SQLITE_LOCKED.
+// The error messages are matched instead of the error codes, so this works across SQLite drivers.
+func isBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/maragudk/goqite"
+	internalsql "github.com/maragudk/goqite/internal/sql"
+)
+
+// rfc3339Milli is the timestamp format of the goqite schema, see [internalsql.RFC3339Milli].
+const rfc3339Milli = internalsql.RFC3339Milli
+
+// SetupHistory creates the goqite_job_runs table for the job run history in db, if it doesn't exist already.
+// Call it before starting a runner with [NewRunnerOpts.RecordHistory]. It's safe to call more than once.
+func SetupHistory(ctx context.Context, db *sql.DB) error {
+	query := `
+		create table if not exists goqite_job_runs (
+			id integer primary key,
+			queue text not null,
+			job text not null,
+			message_id text not null,
+			attempt integer not null,
+			started text not null,
+			finished text not null,
+			success integer not null,
+			error text not null default ''
+		) strict;
+
+		-- Pruning deletes runs by finish time, see PruneRuns
+		create index if not exists goqite_job_runs_finished_idx on goqite_job_runs (finished);`
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// Run is a recorded job run, see [NewRunnerOpts.RecordHistory].
+type Run struct {
+	ID        int64
+	Queue     string
+	Job       string
+	MessageID goqite.ID
+	Attempt   int // How many times the job message had been received when the job ran.
+	Started   time.Time
+	Finished  time.Time
+	Success   bool
+	Error     string // The job error, or the recovered value of a panic, if not successful.
+}
+
+// ListRunsOpts are options for [ListRuns].
+//   - [ListRunsOpts.Cursor] is the cursor returned from a previous call, or empty for the first page.
+//   - [ListRunsOpts.Limit] is the page size, which defaults to 100.
+type ListRunsOpts struct {
+	Cursor string
+	Limit  int
+}
+
+// ListRuns returns a page of recorded job runs in db, newest first, and a cursor for the next page,
+// which is empty if there are no more runs.
+func ListRuns(ctx context.Context, db *sql.DB, opts ListRunsOpts) ([]Run, string, error) {
+	if opts.Limit < 0 {
+		panic("limit cannot be negative")
+	}
+
+	if opts.Limit == 0 {
+		opts.Limit = 100
+	}
+
+	before := int64(-1)
+	if opts.Cursor != "" {
+		var err error
+		before, err = strconv.ParseInt(opts.Cursor, 10, 64)
+		if err != nil {
+			return nil, "", errors.New("invalid cursor")
+		}
+	}
+
+	query := `
+		select id, queue, job, message_id, attempt, started, finished, success, error from goqite_job_runs
+		where ? < 0 or id < ?
+		order by id desc
+		limit ?`
+
+	rows, err := db.QueryContext(ctx, query, before, before, opts.Limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var runs []Run
+	var cursor string
+	for rows.Next() {
+		if len(runs) == opts.Limit {
+			cursor = strconv.FormatInt(runs[len(runs)-1].ID, 10)
+			break
+		}
+		var run Run
+		var started, finished string
+		if err := rows.Scan(&run.ID, &run.Queue, &run.Job, &run.MessageID, &run.Attempt, &started, &finished,
+			&run.Success, &run.Error); err != nil {
+			return nil, "", err
+		}
+		if run.Started, err = time.Parse(rfc3339Milli, started); err != nil {
+			return nil, "", err
+		}
+		if run.Finished, err = time.Parse(rfc3339Milli, finished); err != nil {
+			return nil, "", err
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return runs, cursor, nil
+}
+
+// PruneRuns deletes recorded job runs in db that finished longer than retention ago, and returns how many were deleted.
+// Call it periodically when recording history, so the history doesn't grow without bounds.
+func PruneRuns(ctx context.Context, db *sql.DB, retention time.Duration) (int, error) {
+	if retention < 0 {
+		panic("retention cannot be negative")
+	}
+
+	finished := time.Now().Add(-retention).UTC().Format(rfc3339Milli)
+
+	res, err := db.ExecContext(ctx, `delete from goqite_job_runs where finished <= ?`, finished)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// recordRun in the job run history, with the finish time set to now.
+func recordRun(ctx context.Context, db execer, run Run) error {
+	query := `
+		insert into goqite_job_runs (queue, job, message_id, attempt, started, finished, success, error)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.ExecContext(ctx, query, run.Queue, run.Job, run.MessageID, run.Attempt,
+		run.Started.UTC().Format(rfc3339Milli), time.Now().UTC().Format(rfc3339Milli), run.Success, run.Error)
+	return err
+}
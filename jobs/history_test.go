@@ -0,0 +1,216 @@
+package jobs_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maragudk/is"
+
+	"github.com/maragudk/goqite"
+	internaltesting "github.com/maragudk/goqite/internal/testing"
+	"github.com/maragudk/goqite/jobs"
+)
+
+func TestRunner_RecordHistory(t *testing.T) {
+	t.Run("records completed, failed, and panicked jobs", func(t *testing.T) {
+		db := newHistoryDB(t)
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "jobs", Timeout: time.Minute}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			DB:            db,
+			Limit:         1,
+			Log:           internaltesting.NewLogger(t),
+			PollInterval:  time.Millisecond,
+			Queue:         q,
+			RecordHistory: true,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("succeed", func(ctx context.Context, m []byte) error {
+			return nil
+		})
+		r.Register("fail", func(ctx context.Context, m []byte) error {
+			return errors.New("oh no")
+		})
+		r.Register("panic", func(ctx context.Context, m []byte) error {
+			defer cancel()
+			panic("oh no")
+		})
+
+		for _, name := range []string{"succeed", "fail", "panic"} {
+			err := jobs.Create(ctx, q, name, nil)
+			is.NotError(t, err)
+		}
+
+		before := time.Now()
+		r.Start(ctx)
+
+		runs, cursor, err := jobs.ListRuns(context.Background(), db, jobs.ListRunsOpts{})
+		is.NotError(t, err)
+		is.Equal(t, "", cursor)
+		is.Equal(t, 3, len(runs))
+
+		is.Equal(t, "panic", runs[0].Job)
+		is.True(t, !runs[0].Success)
+		is.Equal(t, "panic: oh no", runs[0].Error)
+
+		is.Equal(t, "fail", runs[1].Job)
+		is.True(t, !runs[1].Success)
+		is.Equal(t, "oh no", runs[1].Error)
+
+		is.Equal(t, "succeed", runs[2].Job)
+		is.True(t, runs[2].Success)
+		is.Equal(t, "", runs[2].Error)
+		is.Equal(t, "jobs", runs[2].Queue)
+		is.Equal(t, 1, runs[2].Attempt)
+		is.True(t, runs[2].MessageID != "")
+		is.True(t, !runs[2].Started.Before(before.Truncate(time.Millisecond)))
+		is.True(t, !runs[2].Finished.Before(runs[2].Started))
+	})
+
+	t.Run("records jobs run in a single transaction", func(t *testing.T) {
+		db := newHistoryDB(t)
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Timeout: time.Minute}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			DB:            db,
+			Log:           internaltesting.NewLogger(t),
+			PollInterval:  time.Millisecond,
+			Queue:         q,
+			RecordHistory: true,
+			SingleTx:      true,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("succeed", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			return nil
+		})
+		r.RegisterTx("fail", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			cancel()
+			return errors.New("oh no")
+		})
+
+		err := jobs.Create(ctx, q, "succeed", nil)
+		is.NotError(t, err)
+		err = jobs.Create(ctx, q, "fail", nil)
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		runs, _, err := jobs.ListRuns(context.Background(), db, jobs.ListRunsOpts{})
+		is.NotError(t, err)
+		is.Equal(t, 2, len(runs))
+		is.Equal(t, "fail", runs[0].Job)
+		is.Equal(t, "oh no", runs[0].Error)
+		is.Equal(t, "succeed", runs[1].Job)
+		is.True(t, runs[1].Success)
+	})
+
+	t.Run("panics without a db", func(t *testing.T) {
+		defer func() {
+			is.Equal[any](t, "db cannot be nil with record history", recover())
+		}()
+		jobs.NewRunner(jobs.NewRunnerOpts{RecordHistory: true})
+	})
+}
+
+func TestListRuns(t *testing.T) {
+	t.Run("pages through runs newest first", func(t *testing.T) {
+		db := newHistoryDB(t)
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			DB:            db,
+			Limit:         1,
+			Log:           internaltesting.NewLogger(t),
+			PollInterval:  time.Millisecond,
+			Queue:         q,
+			RecordHistory: true,
+		})
+
+		var count int
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			count++
+			if count == 5 {
+				cancel()
+			}
+			return nil
+		})
+
+		for i := 0; i < 5; i++ {
+			err := jobs.Create(ctx, q, "test", nil)
+			is.NotError(t, err)
+		}
+
+		r.Start(ctx)
+
+		var ids []int64
+		var cursor string
+		for {
+			runs, next, err := jobs.ListRuns(context.Background(), db, jobs.ListRunsOpts{Cursor: cursor, Limit: 2})
+			is.NotError(t, err)
+			for _, run := range runs {
+				ids = append(ids, run.ID)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		is.Equal(t, 5, len(ids))
+		for i := 1; i < len(ids); i++ {
+			is.True(t, ids[i] < ids[i-1])
+		}
+	})
+
+	t.Run("errors on an invalid cursor", func(t *testing.T) {
+		db := newHistoryDB(t)
+
+		_, _, err := jobs.ListRuns(context.Background(), db, jobs.ListRunsOpts{Cursor: "nope"})
+		is.True(t, err != nil)
+	})
+}
+
+func TestPruneRuns(t *testing.T) {
+	t.Run("deletes runs that finished before the retention", func(t *testing.T) {
+		db := newHistoryDB(t)
+
+		_, err := db.Exec(`
+			insert into goqite_job_runs (queue, job, message_id, attempt, started, finished, success)
+			values
+				('jobs', 'old', 'm_1', 1, '2020-01-01T00:00:00.000Z', '2020-01-01T00:00:01.000Z', 1),
+				('jobs', 'new', 'm_2', 1, strftime('%Y-%m-%dT%H:%M:%fZ'), strftime('%Y-%m-%dT%H:%M:%fZ'), 1)`)
+		is.NotError(t, err)
+
+		n, err := jobs.PruneRuns(context.Background(), db, time.Hour)
+		is.NotError(t, err)
+		is.Equal(t, 1, n)
+
+		runs, _, err := jobs.ListRuns(context.Background(), db, jobs.ListRunsOpts{})
+		is.NotError(t, err)
+		is.Equal(t, 1, len(runs))
+		is.Equal(t, "new", runs[0].Job)
+	})
+}
+
+func TestSetupHistory(t *testing.T) {
+	t.Run("is idempotent", func(t *testing.T) {
+		db := newHistoryDB(t)
+
+		err := jobs.SetupHistory(context.Background(), db)
+		is.NotError(t, err)
+	})
+}
+
+// newHistoryDB returns a database with the goqite schema and the job run history table.
+func newHistoryDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db := internaltesting.NewDB(t, ":memory:")
+	if err := jobs.SetupHistory(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
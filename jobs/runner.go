@@ -9,29 +9,83 @@ package jobs
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"runtime"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/maragudk/goqite"
+	internalsql "github.com/maragudk/goqite/internal/sql"
 )
 
 // NewRunnerOpts are options for [NewRunner].
+//   - [NewRunnerOpts.DB] is the database of the queues, needed for jobs registered with [Runner.RegisterTx].
+//   - [NewRunnerOpts.DeleteTimeout] is how long the runner waits for the message of a job that ran successfully
+//     to be deleted. It's independent of the runner context, so it also applies during shutdown. Defaults to one second.
 //   - [NewRunner.Extend] is by how much a job message timeout is extended each time while the job is running.
-//   - [NewRunnerOpts.Limit] is for how many jobs can be run simultaneously.
+//   - [NewRunnerOpts.Limit] is for how many jobs without a pool can be run simultaneously. Jobs in a pool are
+//     limited by the pool size instead, see [WithPool].
 //   - [NewRunner.PollInterval] is how often the runner polls the queue for new messages.
+//   - [NewRunnerOpts.MaxPollInterval] enables adaptive polling: while the queue is empty, the poll interval doubles
+//     up to this maximum, and goes back to PollInterval as soon as a message is received. Zero means fixed polling.
+//   - [NewRunnerOpts.Queues] are more queues to receive job messages from, in addition to [NewRunnerOpts.Queue].
+//     The runner polls them in round-robin order, and jobs are run by name regardless of the queue they came from,
+//     unless they are registered with [WithQueue]. At least one of Queue and Queues must be set.
+//   - [NewRunnerOpts.RecordHistory] records each job run with its outcome in the goqite_job_runs table in DB,
+//     which must have been created with [SetupHistory].
+//     See [ListRuns] for listing them, and [PruneRuns] for deleting old ones.
+//   - [NewRunnerOpts.ReleaseOnShutdown] makes the messages of jobs that fail during shutdown immediately visible again,
+//     so other runners can pick them up without waiting for the message timeout.
+//   - [NewRunnerOpts.MaxRunDuration] is how long a job can run before its message timeout is not extended anymore,
+//     and [NewRunnerOpts.OnLongRunning] is called. Zero means no limit.
+//   - [NewRunnerOpts.StartupDelay] is how long the runner waits before polling the queue for the first time,
+//     plus a random duration up to [NewRunnerOpts.StartupJitter]. Use it to spread out load when starting many
+//     runners at once.
+//   - [NewRunnerOpts.PoisonThreshold] is the fraction of the queue max receive count at which the runner logs a
+//     possible poison message warning when receiving a job message, before the message can't be received anymore.
+//     For example, 0.5 warns from the second receive with a max receive count of 3. Zero means no warning.
+//   - [NewRunnerOpts.Propagator] extracts values such as trace context from job messages into the job context,
+//     if they were created with [WithPropagator].
+//   - [NewRunnerOpts.SingleTx] receives each job message, runs its job, and deletes the message in a single
+//     transaction on DB, with a savepoint around the job. If the job fails or panics, its changes are rolled back to
+//     the savepoint, but the message receive is still committed, so it's retried after the message timeout like
+//     other failed jobs. Jobs must be registered with [Runner.RegisterTx], and must only use the database through
+//     the transaction they get, for example with [CreateTx] instead of [Create]: with SQLite, the transaction holds the
+//     database write lock while the job runs, so other writers wait for it, and a job that writes outside of it
+//     waits for itself and never finishes. Jobs run one at a time, without message timeout extension.
+//     Use it for short jobs only.
+//   - [NewRunnerOpts.SlowThreshold] makes the runner log a slow job warning with the job name and duration,
+//     for jobs that succeed but take longer than the threshold to run. Zero means no warning.
 type NewRunnerOpts struct {
-	Extend       time.Duration
-	Limit        int
-	Log          logger
-	PollInterval time.Duration
-	Queue        *goqite.Queue
+	DB                *sql.DB
+	DeleteTimeout     time.Duration
+	Extend            time.Duration
+	Limit             int
+	Log               logger
+	MaxPollInterval   time.Duration
+	MaxRunDuration    time.Duration
+	OnLongRunning     func(name string, id goqite.ID, d time.Duration)
+	PoisonThreshold   float64
+	PollInterval      time.Duration
+	Propagator        Propagator
+	Queue             *goqite.Queue
+	Queues            []*goqite.Queue
+	RecordHistory     bool
+	ReleaseOnShutdown bool
+	SingleTx          bool
+	SlowThreshold     time.Duration
+	StartupDelay      time.Duration
+	StartupJitter     time.Duration
 }
 
 func NewRunner(opts NewRunnerOpts) *Runner {
@@ -51,35 +105,157 @@ func NewRunner(opts NewRunnerOpts) *Runner {
 		opts.Extend = 5 * time.Second
 	}
 
+	if opts.DeleteTimeout < 0 {
+		panic("delete timeout cannot be negative")
+	}
+
+	if opts.DeleteTimeout == 0 {
+		opts.DeleteTimeout = time.Second
+	}
+
+	if opts.StartupDelay < 0 {
+		panic("startup delay cannot be negative")
+	}
+
+	if opts.StartupJitter < 0 {
+		panic("startup jitter cannot be negative")
+	}
+
+	if opts.MaxRunDuration < 0 {
+		panic("max run duration cannot be negative")
+	}
+
+	if opts.MaxPollInterval < 0 {
+		panic("max poll interval cannot be negative")
+	}
+
+	if opts.MaxPollInterval > 0 && opts.MaxPollInterval < opts.PollInterval {
+		panic("max poll interval cannot be less than poll interval")
+	}
+
+	if opts.PoisonThreshold < 0 || opts.PoisonThreshold > 1 {
+		panic("poison threshold must be between 0 and 1")
+	}
+
+	if opts.SlowThreshold < 0 {
+		panic("slow threshold cannot be negative")
+	}
+
+	if opts.SingleTx && opts.DB == nil {
+		panic("db cannot be nil with single tx")
+	}
+
+	if opts.RecordHistory && opts.DB == nil {
+		panic("db cannot be nil with record history")
+	}
+
+	var queues []*goqite.Queue
+	if opts.Queue != nil {
+		queues = append(queues, opts.Queue)
+	}
+	queues = append(queues, opts.Queues...)
+
+	if len(queues) == 0 {
+		panic("queue or queues must be set")
+	}
+
 	return &Runner{
-		extend:        opts.Extend,
-		jobCountLimit: opts.Limit,
-		jobs:          make(map[string]Func),
-		log:           opts.Log,
-		pollInterval:  opts.PollInterval,
-		queue:         opts.Queue,
+		db:                opts.DB,
+		deleteTimeout:     opts.DeleteTimeout,
+		extend:            opts.Extend,
+		jobs:              make(map[string]registeredJob),
+		limit:             opts.Limit,
+		log:               opts.Log,
+		maxPollInterval:   opts.MaxPollInterval,
+		maxRunDuration:    opts.MaxRunDuration,
+		onLongRunning:     opts.OnLongRunning,
+		poisonThreshold:   opts.PoisonThreshold,
+		pollInterval:      opts.PollInterval,
+		pools:             make(map[string]int),
+		propagator:        opts.Propagator,
+		queues:            queues,
+		recordHistory:     opts.RecordHistory,
+		releaseOnShutdown: opts.ReleaseOnShutdown,
+		singleTx:          opts.SingleTx,
+		slowThreshold:     opts.SlowThreshold,
+		startupDelay:      opts.StartupDelay,
+		startupJitter:     opts.StartupJitter,
 	}
 }
 
+// Runner runs jobs registered by name, when a message for them is received on the queue. See [NewRunner].
+//
+// Logs about a specific job have the same key/value fields first, to make them easy to index:
+//   - "queue" is the name of the queue the job message was received on.
+//   - "job" is the job name.
+//   - "id" is the job message ID.
+//   - "attempt" is how many times the job message has been received, including this time.
+//
+// Logs after a job has run successfully also have a "duration" field, and logs about errors an "error" field.
 type Runner struct {
-	extend        time.Duration
-	jobCount      int
-	jobCountLimit int
-	jobCountLock  sync.RWMutex
-	jobs          map[string]Func
-	log           logger
-	pollInterval  time.Duration
-	queue         *goqite.Queue
+	db                *sql.DB
+	defaultJob        *registeredJob
+	deleteTimeout     time.Duration
+	extend            time.Duration
+	jobs              map[string]registeredJob
+	limit             int
+	log               logger
+	maxPollInterval   time.Duration
+	maxRunDuration    time.Duration
+	onLongRunning     func(name string, id goqite.ID, d time.Duration)
+	poisonThreshold   float64
+	pollInterval      time.Duration
+	pools             map[string]int // Sizes of the worker pools, see WithPool
+	propagator        Propagator
+	queues            []*goqite.Queue
+	recordHistory     bool
+	releaseOnShutdown bool
+	singleTx          bool
+	slowThreshold     time.Duration
+	startupDelay      time.Duration
+	startupJitter     time.Duration
+	stats             RunStats
+	statsLock         sync.Mutex
+}
+
+// RunStats summarizes the jobs run by [Runner.StartWithStats].
+type RunStats struct {
+	// Completed is the number of jobs that returned without an error.
+	Completed int
+	// Failed is the number of jobs that returned an error while the runner was running.
+	Failed int
+	// Abandoned is the number of jobs that returned an error after the runner started shutting down,
+	// usually because their context was cancelled.
+	Abandoned int
+	// Panicked is the number of jobs that panicked.
+	Panicked int
 }
 
 type message struct {
-	Name    string
-	Message []byte
+	Name     string
+	Message  []byte
+	Metadata map[string]string
+	Deadline time.Time
+}
+
+// deadlinePassed reports whether the job message has a deadline, and it has passed. See [WithDeadline].
+func (m message) deadlinePassed() bool {
+	return !m.Deadline.IsZero() && !time.Now().Before(m.Deadline)
 }
 
 // Start the Runner, blocking until the given context is cancelled.
 // When the context is cancelled, waits for the jobs to finish.
 func (r *Runner) Start(ctx context.Context) {
+	r.StartWithStats(ctx)
+}
+
+// StartWithStats is like [Runner.Start], but returns a summary of the jobs run, after they have all finished.
+// Use it to check for a clean shutdown, for example on deploys.
+func (r *Runner) StartWithStats(ctx context.Context) RunStats {
+	r.statsLock.Lock()
+	r.stats = RunStats{}
+	r.statsLock.Unlock()
+
 	var names []string
 	for k := range r.jobs {
 		names = append(names, k)
@@ -88,33 +264,139 @@ func (r *Runner) Start(ctx context.Context) {
 
 	r.log.Info("Starting", "jobs", names)
 
-	var wg sync.WaitGroup
-
-	for {
+	delay := r.startupDelay
+	if r.startupJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(r.startupJitter)))
+	}
+	if delay > 0 {
+		r.log.Info("Waiting before first poll", "delay", delay)
 		select {
 		case <-ctx.Done():
-			r.log.Info("Stopping")
-			wg.Wait()
-			r.log.Info("Stopped")
-			return
-		default:
-			r.receiveAndRun(ctx, &wg)
+		case <-time.After(delay):
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	if r.singleTx {
+		w := r.newWorker("", 1)
+		for ctx.Err() == nil {
+			r.receiveAndRunInTx(ctx, w)
+		}
+	} else {
+		// Each worker has its own receive loop, so a full pool doesn't hold up the jobs of other pools
+		var loops sync.WaitGroup
+		for _, w := range r.workers() {
+			loops.Add(1)
+			go func(w *worker) {
+				defer loops.Done()
+				for ctx.Err() == nil {
+					r.receiveAndRun(ctx, w, &wg)
+				}
+			}(w)
+		}
+		loops.Wait()
+	}
+
+	r.log.Info("Stopping")
+	wg.Wait()
+
+	r.statsLock.Lock()
+	stats := r.stats
+	r.statsLock.Unlock()
+
+	r.log.Info("Stopped", "completed", stats.Completed, "failed", stats.Failed, "abandoned", stats.Abandoned,
+		"panicked", stats.Panicked)
+	return stats
+}
+
+// worker receives and runs jobs within its own budget of simultaneous jobs: either the jobs of one pool, or the jobs
+// without a pool, selected with a receive filter on the job name. See [WithPool].
+type worker struct {
+	filter          string
+	filterArgs      []any
+	pollIntervalNow time.Duration // Current poll interval with adaptive polling, only used by the worker goroutine
+	pool            string
+	queueIndex      int // Index of the next queue to poll, only used by the worker goroutine
+	slots           chan struct{}
+}
+
+func (r *Runner) newWorker(pool string, size int) *worker {
+	return &worker{
+		pollIntervalNow: r.pollInterval,
+		pool:            pool,
+		slots:           make(chan struct{}, size),
+	}
+}
+
+// workers for the jobs without a pool, and for each pool.
+func (r *Runner) workers() []*worker {
+	var pooled []string
+	poolJobs := map[string][]string{}
+	for name, j := range r.jobs {
+		if j.pool != "" {
+			pooled = append(pooled, name)
+			poolJobs[j.pool] = append(poolJobs[j.pool], name)
+		}
+	}
+
+	// Job messages without the header, created before it was added, are received by the worker without a pool
+	w := r.newWorker("", r.limit)
+	if len(pooled) > 0 {
+		filter, args := nameFilter(pooled)
+		w.filter = `not (` + filter + `)`
+		w.filterArgs = args
+	}
+	workers := []*worker{w}
+
+	var pools []string
+	for pool := range poolJobs {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		w := r.newWorker(pool, r.pools[pool])
+		w.filter, w.filterArgs = nameFilter(poolJobs[pool])
+		workers = append(workers, w)
+	}
+
+	return workers
+}
+
+// nameFilter is a receive filter for the messages of the named jobs, by their envelope header. See [encodeHeader].
+func nameFilter(names []string) (string, []any) {
+	sort.Strings(names)
+
+	var filter string
+	var args []any
+	for i, name := range names {
+		if i > 0 {
+			filter += ` or `
 		}
+		header := encodeHeader(name)
+		filter += `substr(body, 1, ?) = ?`
+		args = append(args, len(header), header)
 	}
+	return filter, args
 }
 
-func (r *Runner) receiveAndRun(ctx context.Context, wg *sync.WaitGroup) {
-	r.jobCountLock.RLock()
-	if r.jobCount == r.jobCountLimit {
-		r.jobCountLock.RUnlock()
-		// This is to avoid a busy loop
-		time.Sleep(r.pollInterval)
+// receiveAndRun receives a message with the worker as soon as it has a free slot, and runs its job in the slot.
+func (r *Runner) receiveAndRun(ctx context.Context, w *worker, wg *sync.WaitGroup) {
+	// Only receive with a free slot, so a received message never waits for one while its timeout runs out
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
 		return
-	} else {
-		r.jobCountLock.RUnlock()
 	}
+	release := true
+	defer func() {
+		if release {
+			<-w.slots
+		}
+	}()
 
-	m, err := r.queue.ReceiveAndWait(ctx, r.pollInterval)
+	m, q, err := r.receive(ctx, w)
 	if err != nil {
 		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
 			return
@@ -129,40 +411,93 @@ func (r *Runner) receiveAndRun(ctx context.Context, wg *sync.WaitGroup) {
 		return
 	}
 
-	var jm message
-	if err := gob.NewDecoder(bytes.NewReader(m.Body)).Decode(&jm); err != nil {
-		r.log.Info("Error decoding job message body", "error", err)
+	jm, err := decode(m.Body)
+	if err != nil {
+		r.log.Info("Error decoding job message body", "queue", q.Name(), "id", m.ID, "attempt", m.Received, "error", err)
 		return
 	}
 
-	job, ok := r.jobs[jm.Name]
+	// Log fields for the job, see the Runner documentation
+	fields := []any{"queue", q.Name(), "job", jm.Name, "id", m.ID, "attempt", m.Received}
+	withFields := func(args ...any) []any {
+		return append(fields[:len(fields):len(fields)], args...)
+	}
+
+	if r.poisonThreshold > 0 && float64(m.Received) >= r.poisonThreshold*float64(q.MaxReceive()) {
+		r.log.Info("Warning: possible poison message, received many times", withFields("maxReceive", q.MaxReceive())...)
+	}
+
+	// Leave the message of an unknown job, for example from a newer version of the application during a rolling deploy,
+	// to be received again after its timeout, until it has been received the maximum number of times
+	job, ok := r.job(jm.Name)
 	if !ok {
-		panic(fmt.Sprintf(`job "%v" not registered`, jm.Name))
+		r.log.Info("Job not registered, leaving message for redelivery", fields...)
+		return
 	}
 
-	r.jobCountLock.Lock()
-	r.jobCount++
-	r.jobCountLock.Unlock()
+	if job.queue != "" && job.queue != q.Name() {
+		r.log.Info("Job registered for another queue, leaving message for redelivery", withFields("jobQueue", job.queue)...)
+		return
+	}
 
+	if jm.deadlinePassed() {
+		r.log.Info("Job deadline passed, deleting message instead of running job", withFields("deadline", jm.Deadline)...)
+		deleteCtx, cancel := context.WithTimeout(context.Background(), r.deleteTimeout)
+		defer cancel()
+		if err := q.Delete(deleteCtx, m.ID); err != nil {
+			r.log.Info("Error deleting job from queue, it will be retried", withFields("error", err)...)
+		}
+		return
+	}
+
+	release = false
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
 		defer func() {
-			r.jobCountLock.Lock()
-			r.jobCount--
-			r.jobCountLock.Unlock()
+			<-w.slots
+		}()
+
+		// Record the run after the panic recovery below, so panicking jobs are recorded as well
+		var run *Run
+		defer func() {
+			if run == nil {
+				return
+			}
+			recordCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := recordRun(recordCtx, r.db, *run); err != nil {
+				r.log.Info("Error recording job run", withFields("error", err)...)
+			}
 		}()
 
 		defer func() {
 			if rec := recover(); rec != nil {
-				r.log.Info("Recovered from panic in job", "error", rec)
+				r.log.Info("Recovered from panic in job", withFields("error", rec)...)
+				r.count(func(s *RunStats) { s.Panicked++ })
+				if run != nil {
+					run.Error = fmt.Sprintf("panic: %v", rec)
+				}
 			}
 		}()
 
-		jobCtx, cancel := context.WithCancel(ctx)
+		jobCtx, cancel := context.WithCancel(context.WithValue(ctx, jobNameContextKey{}, jm.Name))
 		defer cancel()
 
+		if r.propagator != nil && len(jm.Metadata) > 0 {
+			jobCtx = r.propagator.Extract(jobCtx, jm.Metadata)
+		}
+
+		// The extension below stops when the job context is done, so a message is not extended past its deadline
+		if !jm.Deadline.IsZero() {
+			var cancelDeadline context.CancelFunc
+			jobCtx, cancelDeadline = context.WithDeadline(jobCtx, jm.Deadline)
+			defer cancelDeadline()
+		}
+
+		started := time.Now()
+
 		// Extend the job message while the job is running
 		go func() {
 			// Start by sleeping so we don't extend immediately
@@ -172,58 +507,708 @@ func (r *Runner) receiveAndRun(ctx context.Context, wg *sync.WaitGroup) {
 				case <-jobCtx.Done():
 					return
 				default:
-					r.log.Info("Extending message timeout", "name", jm.Name)
-					if err := r.queue.Extend(jobCtx, m.ID, r.extend); err != nil {
-						r.log.Info("Error extending message timeout", "error", err)
+					// Stop extending a job that has run for too long, so it doesn't hold the message indefinitely
+					if d := time.Since(started); r.maxRunDuration > 0 && d > r.maxRunDuration {
+						r.log.Info("Job has been running for too long, not extending message timeout anymore",
+							withFields("duration", d)...)
+						if r.onLongRunning != nil {
+							r.onLongRunning(jm.Name, m.ID, d)
+						}
+						return
+					}
+
+					r.log.Info("Extending message timeout", fields...)
+					if err := q.Extend(jobCtx, m.ID, r.extend); err != nil {
+						r.log.Info("Error extending message timeout", withFields("error", err)...)
 					}
 					time.Sleep(r.extend - r.extend/5)
 				}
 			}
 		}()
 
-		r.log.Info("Running job", "name", jm.Name)
+		// The job timeout has its own context, so a timeout can be told apart from the deadline and shutdown below
+		runCtx := jobCtx
+		if job.timeout > 0 {
+			var cancelTimeout context.CancelFunc
+			runCtx, cancelTimeout = context.WithTimeout(jobCtx, job.timeout)
+			defer cancelTimeout()
+		}
+
+		r.log.Info("Running job", fields...)
 		before := time.Now()
-		if err := job(jobCtx, jm.Message); err != nil {
-			r.log.Info("Error running job", "name", jm.Name, "error", err)
+		if r.recordHistory {
+			run = &Run{Queue: q.Name(), Job: jm.Name, MessageID: m.ID, Attempt: m.Received, Started: before}
+		}
+		var err error
+		if job.txFn != nil {
+			err = r.runTx(runCtx, q, m.ID, job.txFn, jm.Message)
+		} else {
+			err = job.fn(runCtx, jm.Message)
+		}
+		if run != nil {
+			run.Success = err == nil
+			if err != nil {
+				run.Error = err.Error()
+			}
+		}
+		if err != nil {
+			r.log.Info("Error running job", withFields("error", err)...)
+			if ctx.Err() != nil {
+				r.count(func(s *RunStats) { s.Abandoned++ })
+			} else {
+				r.count(func(s *RunStats) { s.Failed++ })
+			}
+
+			// Release the message of a job that timed out right away, instead of holding it until its message timeout
+			if runCtx.Err() != nil && jobCtx.Err() == nil {
+				r.log.Info("Job timed out, releasing message", withFields("timeout", job.timeout)...)
+				releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				if err := q.Nack(releaseCtx, m.ID); err != nil {
+					r.log.Info("Error releasing job message after timeout", withFields("error", err)...)
+				}
+				return
+			}
+
+			// Only release if the runner is shutting down, so regular job errors still wait for the timeout
+			if r.releaseOnShutdown && ctx.Err() != nil {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				if err := q.Nack(releaseCtx, m.ID); err != nil {
+					r.log.Info("Error releasing job message on shutdown", withFields("error", err)...)
+				}
+			}
 			return
 		}
 		duration := time.Since(before)
-		r.log.Info("Ran job", "name", jm.Name, "duration", duration)
+		r.log.Info("Ran job", withFields("duration", duration)...)
+		r.count(func(s *RunStats) { s.Completed++ })
+		if r.slowThreshold > 0 && duration > r.slowThreshold {
+			r.log.Info("Warning: job ran slowly", withFields("duration", duration, "threshold", r.slowThreshold)...)
+		}
+
+		// Tx jobs have deleted their message already, in the same transaction
+		if job.txFn != nil {
+			return
+		}
 
-		deleteCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		deleteCtx, cancel := context.WithTimeout(context.Background(), r.deleteTimeout)
 		defer cancel()
-		if err := r.queue.Delete(deleteCtx, m.ID); err != nil {
-			r.log.Info("Error deleting job from queue, it will be retried", "error", err)
+		if err := q.Delete(deleteCtx, m.ID); err != nil {
+			r.log.Info("Error deleting job from queue, it will be retried", withFields("error", err)...)
+		}
+	}()
+}
+
+// count updates the run stats with f.
+func (r *Runner) count(f func(s *RunStats)) {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	f(&r.stats)
+}
+
+// receiveAndRunInTx receives a message from the next queue with one, runs its job, and deletes the message,
+// all in one transaction. See [NewRunnerOpts.SingleTx].
+func (r *Runner) receiveAndRunInTx(ctx context.Context, w *worker) {
+	for range r.queues {
+		q := r.queues[w.queueIndex]
+		w.queueIndex = (w.queueIndex + 1) % len(r.queues)
+
+		var received bool
+		err := internalsql.InTxWithOpts(r.db, internalsql.InTxOpts{Log: r.log}, func(tx *sql.Tx) error {
+			m, err := q.ReceiveTx(ctx, tx)
+			if err != nil || m == nil {
+				return err
+			}
+			received = true
+			return r.runInTx(ctx, tx, q, m)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.log.Info("Error receiving and running job", "queue", q.Name(), "error", err)
+			// Sleep a bit to not hammer the queue if there's an error with it
+			time.Sleep(time.Second)
+			return
 		}
+		if received {
+			return
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(r.pollInterval):
+	}
+}
+
+// runInTx runs the job for m within a savepoint in tx, and deletes m in tx if the job succeeds.
+// If the job fails, only the job changes are rolled back, and nil is returned, so the message receive is committed.
+func (r *Runner) runInTx(ctx context.Context, tx *sql.Tx, q *goqite.Queue, m *goqite.Message) error {
+	jm, err := decode(m.Body)
+	if err != nil {
+		r.log.Info("Error decoding job message body", "queue", q.Name(), "id", m.ID, "attempt", m.Received, "error", err)
+		return nil
+	}
+
+	fields := []any{"queue", q.Name(), "job", jm.Name, "id", m.ID, "attempt", m.Received}
+	withFields := func(args ...any) []any {
+		return append(fields[:len(fields):len(fields)], args...)
+	}
+
+	job, ok := r.job(jm.Name)
+	if !ok {
+		r.log.Info("Job not registered, leaving message for redelivery", fields...)
+		return nil
+	}
+
+	if job.queue != "" && job.queue != q.Name() {
+		r.log.Info("Job registered for another queue, leaving message for redelivery", withFields("jobQueue", job.queue)...)
+		return nil
+	}
+
+	if jm.deadlinePassed() {
+		r.log.Info("Job deadline passed, deleting message instead of running job", withFields("deadline", jm.Deadline)...)
+		deleteCtx, cancelDelete := context.WithTimeout(context.Background(), r.deleteTimeout)
+		defer cancelDelete()
+		return q.DeleteTx(deleteCtx, tx, m.ID)
+	}
+
+	jobCtx, cancel := context.WithCancel(context.WithValue(ctx, jobNameContextKey{}, jm.Name))
+	defer cancel()
+
+	if r.propagator != nil && len(jm.Metadata) > 0 {
+		jobCtx = r.propagator.Extract(jobCtx, jm.Metadata)
+	}
+
+	if !jm.Deadline.IsZero() {
+		var cancelDeadline context.CancelFunc
+		jobCtx, cancelDeadline = context.WithDeadline(jobCtx, jm.Deadline)
+		defer cancelDeadline()
+	}
+
+	if job.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		jobCtx, cancelTimeout = context.WithTimeout(jobCtx, job.timeout)
+		defer cancelTimeout()
+	}
+
+	if _, err := tx.ExecContext(ctx, `savepoint job`); err != nil {
+		return err
+	}
+
+	r.log.Info("Running job", fields...)
+	before := time.Now()
+	var panicked bool
+	err = func() (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				panicked = true
+				err = fmt.Errorf("panic: %v", rec)
+			}
+		}()
+		return job.txFn(jobCtx, tx, jm.Message)
 	}()
+	if err != nil {
+		switch {
+		case panicked:
+			r.log.Info("Recovered from panic in job", withFields("error", err)...)
+			r.count(func(s *RunStats) { s.Panicked++ })
+		case ctx.Err() != nil:
+			r.log.Info("Error running job", withFields("error", err)...)
+			r.count(func(s *RunStats) { s.Abandoned++ })
+		default:
+			r.log.Info("Error running job", withFields("error", err)...)
+			r.count(func(s *RunStats) { s.Failed++ })
+		}
+
+		// Use a background context, so the message receive is still committed if the runner is shutting down
+		if _, err := tx.ExecContext(context.Background(), `rollback to job`); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(context.Background(), `release job`); err != nil {
+			return err
+		}
+		if r.recordHistory {
+			run := Run{Queue: q.Name(), Job: jm.Name, MessageID: m.ID, Attempt: m.Received, Started: before, Error: err.Error()}
+			return recordRun(context.Background(), tx, run)
+		}
+		return nil
+	}
+
+	duration := time.Since(before)
+	r.log.Info("Ran job", withFields("duration", duration)...)
+	r.count(func(s *RunStats) { s.Completed++ })
+	if r.slowThreshold > 0 && duration > r.slowThreshold {
+		r.log.Info("Warning: job ran slowly", withFields("duration", duration, "threshold", r.slowThreshold)...)
+	}
+
+	// Like the regular delete, don't let a shutdown during the delete roll back a job that succeeded
+	deleteCtx, cancelDelete := context.WithTimeout(context.Background(), r.deleteTimeout)
+	defer cancelDelete()
+	if err := q.DeleteTx(deleteCtx, tx, m.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(deleteCtx, `release job`); err != nil {
+		return err
+	}
+	if r.recordHistory {
+		run := Run{Queue: q.Name(), Job: jm.Name, MessageID: m.ID, Attempt: m.Received, Started: before, Success: true}
+		return recordRun(deleteCtx, tx, run)
+	}
+	return nil
+}
+
+// runTx runs the tx job and deletes its message in the same transaction.
+func (r *Runner) runTx(ctx context.Context, q *goqite.Queue, id goqite.ID, job TxFunc, m []byte) error {
+	return internalsql.InTxWithOpts(r.db, internalsql.InTxOpts{Log: r.log}, func(tx *sql.Tx) error {
+		if err := job(ctx, tx, m); err != nil {
+			return err
+		}
+
+		// Like the regular delete, don't let a shutdown during the delete roll back a job that succeeded
+		deleteCtx, cancel := context.WithTimeout(context.Background(), r.deleteTimeout)
+		defer cancel()
+		return q.DeleteTx(deleteCtx, tx, id)
+	})
+}
+
+// receive the next message for the worker and the queue it came from, polling the queues at a fixed or adaptive
+// interval. See [NewRunnerOpts.MaxPollInterval] and [NewRunnerOpts.Queues].
+func (r *Runner) receive(ctx context.Context, w *worker) (*goqite.Message, *goqite.Queue, error) {
+	var opts []goqite.ReceiveOption
+	if w.filter != "" {
+		opts = append(opts, goqite.WithFilter(w.filter, w.filterArgs...))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(w.pollIntervalNow):
+		}
+
+		for range r.queues {
+			q := r.queues[w.queueIndex]
+			w.queueIndex = (w.queueIndex + 1) % len(r.queues)
+
+			m, err := q.Receive(ctx, opts...)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, nil, ctx.Err()
+				}
+				return nil, nil, err
+			}
+
+			if m != nil {
+				w.pollIntervalNow = r.pollInterval
+				return m, q, nil
+			}
+		}
+
+		if r.maxPollInterval > 0 && w.pollIntervalNow < r.maxPollInterval {
+			w.pollIntervalNow = min(2*w.pollIntervalNow, r.maxPollInterval)
+			args := []any{"interval", w.pollIntervalNow}
+			if w.pool != "" {
+				args = append(args, "pool", w.pool)
+			}
+			r.log.Info("No jobs, increasing poll interval", args...)
+		}
+	}
 }
 
 // Func is a job to be done. It gets the message m from the queue.
 type Func func(ctx context.Context, m []byte) error
 
-func (r *Runner) Register(name string, job Func) {
+// RegisterOption is an option for [Runner.Register].
+type RegisterOption func(*registeredJob)
+
+type registeredJob struct {
+	fn       Func
+	pool     string
+	poolSize int
+	queue    string
+	timeout  time.Duration
+	txFn     TxFunc
+}
+
+// WithPool runs the job in the named worker pool, which runs at most size jobs at a time. Jobs in the same pool
+// share its slots, independent of other pools and of [NewRunnerOpts.Limit], which is for jobs without a pool.
+// Each pool receives job messages by itself, and only when it has a free slot, so a full pool leaves the messages of
+// its jobs in the queue, and never holds up the jobs of other pools. Pools can't be used for the default job,
+// and have no effect with [NewRunnerOpts.SingleTx].
+func WithPool(name string, size int) RegisterOption {
+	if name == "" {
+		panic("pool name cannot be empty")
+	}
+
+	if size <= 0 {
+		panic("pool size must be larger than zero")
+	}
+
+	return func(j *registeredJob) {
+		j.pool = name
+		j.poolSize = size
+	}
+}
+
+// WithQueue only runs the job for messages received on q, which must be one of the runner queues.
+// A message for the job received on another queue is left for redelivery, like a message for a job that is not
+// registered. See [NewRunnerOpts.Queues].
+func WithQueue(q *goqite.Queue) RegisterOption {
+	if q == nil {
+		panic("queue cannot be nil")
+	}
+
+	return func(j *registeredJob) {
+		j.queue = q.Name()
+	}
+}
+
+// WithTimeout cancels the job context after d. If the job then returns an error, its message is released right away,
+// so it can be received again, instead of waiting for the message timeout. The release counts towards the max receive
+// count of the queue like any other failure.
+func WithTimeout(d time.Duration) RegisterOption {
+	if d <= 0 {
+		panic("timeout must be larger than zero")
+	}
+
+	return func(j *registeredJob) {
+		j.timeout = d
+	}
+}
+
+// Register the job with the given name, so it's run when a message for it is received.
+// It panics with [NewRunnerOpts.SingleTx], which requires [Runner.RegisterTx].
+func (r *Runner) Register(name string, job Func, opts ...RegisterOption) {
+	if r.singleTx {
+		panic("jobs must be registered with RegisterTx with single tx")
+	}
+
+	r.register(name, registeredJob{fn: job}, opts)
+}
+
+// RegisterDefault registers a job that is run for job messages with a name that no job is registered with,
+// for example to log or archive jobs created by a newer version of the application during a rolling deploy.
+// Use [JobName] to get the name of the job in the default job. Like [Runner.Register], it panics with
+// [NewRunnerOpts.SingleTx].
+func (r *Runner) RegisterDefault(job Func, opts ...RegisterOption) {
+	if r.singleTx {
+		panic("jobs must be registered with RegisterTx with single tx")
+	}
+
+	if r.defaultJob != nil {
+		panic("default job already registered")
+	}
+
+	j := r.withOpts(registeredJob{fn: job}, opts)
+	// The default job runs for any job name, so its messages can't be selected for a pool by name
+	if j.pool != "" {
+		panic("default job cannot be run in a pool")
+	}
+	r.defaultJob = &j
+}
+
+// job registered with the given name, or the default job if there is none and it's registered.
+func (r *Runner) job(name string) (registeredJob, bool) {
+	if j, ok := r.jobs[name]; ok {
+		return j, true
+	}
+	if r.defaultJob != nil {
+		return *r.defaultJob, true
+	}
+	return registeredJob{}, false
+}
+
+type jobNameContextKey struct{}
+
+// JobName returns the name of the job from the job context, or an empty string if ctx is not a job context.
+func JobName(ctx context.Context) string {
+	name, _ := ctx.Value(jobNameContextKey{}).(string)
+	return name
+}
+
+func (r *Runner) register(name string, j registeredJob, opts []RegisterOption) {
 	if _, ok := r.jobs[name]; ok {
 		panic(fmt.Sprintf(`job "%v" already registered`, name))
 	}
-	r.jobs[name] = job
+
+	r.jobs[name] = r.withOpts(j, opts)
 }
 
-// Create a message for the named job in the given queue.
-func Create(ctx context.Context, q *goqite.Queue, name string, m []byte) error {
+// withOpts applies the register options to j, checks its queue, and adds its worker pool if needed.
+func (r *Runner) withOpts(j registeredJob, opts []RegisterOption) registeredJob {
+	for _, opt := range opts {
+		opt(&j)
+	}
+
+	if j.queue != "" && !r.hasQueue(j.queue) {
+		panic(fmt.Sprintf(`queue "%v" is not one of the runner queues`, j.queue))
+	}
+
+	if j.pool != "" {
+		size, ok := r.pools[j.pool]
+		if !ok {
+			r.pools[j.pool] = j.poolSize
+		} else if size != j.poolSize {
+			panic(fmt.Sprintf(`pool "%v" already registered with a different size`, j.pool))
+		}
+	}
+
+	return j
+}
+
+// hasQueue reports whether the runner receives from the queue with the given name.
+func (r *Runner) hasQueue(name string) bool {
+	for _, q := range r.queues {
+		if q.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// TxFunc is a job to be done within a transaction. It gets the message m from the queue.
+type TxFunc func(ctx context.Context, tx *sql.Tx, m []byte) error
+
+// RegisterTx is like Register, but for a job that runs within a transaction, in which the runner also deletes the job
+// message after the job succeeds. So the database changes of the job and the message deletion are committed together,
+// and a job that succeeded is never run again. If the job returns an error, both are rolled back.
+// It requires [NewRunnerOpts.DB] to be set. Note that with a single database connection, message timeout extension
+// waits for the transaction to finish.
+func (r *Runner) RegisterTx(name string, job TxFunc, opts ...RegisterOption) {
+	if r.db == nil {
+		panic("db cannot be nil when registering tx jobs")
+	}
+
+	r.register(name, registeredJob{txFn: job}, opts)
+}
+
+// RegisterTyped registers a job with the given name on r, like [Runner.Register], but decodes the message into a T
+// with gob before calling fn. Use [CreateTyped] to create messages for it.
+// A message that cannot be decoded is logged and dropped instead of retried, because retrying cannot make it decodable.
+func RegisterTyped[T any](r *Runner, name string, fn func(ctx context.Context, v T) error, opts ...RegisterOption) {
+	r.Register(name, func(ctx context.Context, m []byte) error {
+		var v T
+		if err := gob.NewDecoder(bytes.NewReader(m)).Decode(&v); err != nil {
+			r.log.Info("Error decoding typed job message, dropping it", "job", name, "error", err)
+			return nil
+		}
+		return fn(ctx, v)
+	}, opts...)
+}
+
+// CreateTyped creates a message for the named job in the given queue, like [Create], but encodes v with gob.
+// The job should be registered with [RegisterTyped].
+func CreateTyped[T any](ctx context.Context, q *goqite.Queue, name string, v T, opts ...CreateOption) error {
 	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(message{Name: name, Message: m}); err != nil {
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return Create(ctx, q, name, buf.Bytes(), opts...)
+}
+
+// Propagator carries request-scoped values such as trace context from the context of the job creator to the
+// context of the job, through the job message metadata.
+// It matches the shape of the usual trace propagators, so they can be adapted to it with a few lines of code.
+type Propagator interface {
+	// Inject the values to propagate from ctx into metadata.
+	Inject(ctx context.Context, metadata map[string]string)
+	// Extract the values from metadata into a new context derived from ctx.
+	Extract(ctx context.Context, metadata map[string]string) context.Context
+}
+
+// CreateOption is an option for [Create] and friends.
+type CreateOption func(*createOpts)
+
+type createOpts struct {
+	compress   bool
+	deadline   time.Time
+	delay      time.Duration
+	propagator Propagator
+}
+
+// WithCompression compresses the job message with gzip, which is worth it for large, compressible payloads.
+// The [Runner] detects compressed messages by itself, so no runner option is needed.
+func WithCompression() CreateOption {
+	return func(o *createOpts) {
+		o.compress = true
+	}
+}
+
+// WithDeadline sets a hard deadline for the job, after which its context is cancelled, no matter how many times its
+// message timeout has been extended. A job message received after the deadline is deleted without running the job.
+func WithDeadline(t time.Time) CreateOption {
+	return func(o *createOpts) {
+		o.deadline = t
+	}
+}
+
+// WithDelay delays the job, so its message can't be received before the delay has passed.
+func WithDelay(d time.Duration) CreateOption {
+	if d < 0 {
+		panic("delay cannot be negative")
+	}
+
+	return func(o *createOpts) {
+		o.delay = d
+	}
+}
+
+// WithPropagator injects values from the creating context into the job message with p.
+// The [Runner] extracts them into the job context with its own [NewRunnerOpts.Propagator].
+func WithPropagator(p Propagator) CreateOption {
+	return func(o *createOpts) {
+		o.propagator = p
+	}
+}
+
+// Create a message for the named job in the given queue.
+func Create(ctx context.Context, q *goqite.Queue, name string, m []byte, opts ...CreateOption) error {
+	qm, err := encode(ctx, name, m, opts)
+	if err != nil {
 		return err
 	}
-	return q.Send(ctx, goqite.Message{Body: buf.Bytes()})
+	return q.Send(ctx, qm)
 }
 
 // CreateTx is like Create, but within an existing transaction.
-func CreateTx(ctx context.Context, tx *sql.Tx, q *goqite.Queue, name string, m []byte) error {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(message{Name: name, Message: m}); err != nil {
+func CreateTx(ctx context.Context, tx *sql.Tx, q *goqite.Queue, name string, m []byte, opts ...CreateOption) error {
+	qm, err := encode(ctx, name, m, opts)
+	if err != nil {
 		return err
 	}
-	return q.SendTx(ctx, tx, goqite.Message{Body: buf.Bytes()})
+	return q.SendTx(ctx, tx, qm)
+}
+
+// CreateUnique is like [Create], but only creates the job if there's no job with the same name and dedupKey
+// in the queue already, received or not. It returns whether the job was newly created.
+// It uses the queue's [goqite.Message.DedupKey], so the key is free again as soon as the job has run successfully.
+func CreateUnique(ctx context.Context, q *goqite.Queue, name string, m []byte, dedupKey string, opts ...CreateOption) (bool, error) {
+	qm, err := encode(ctx, name, m, opts)
+	if err != nil {
+		return false, err
+	}
+	qm.DedupKey = uniqueKey(name, dedupKey)
+	_, created, err := q.SendIdempotent(ctx, qm)
+	return created, err
+}
+
+// CreateUniqueTx is like CreateUnique, but within an existing transaction.
+func CreateUniqueTx(ctx context.Context, tx *sql.Tx, q *goqite.Queue, name string, m []byte, dedupKey string, opts ...CreateOption) (bool, error) {
+	qm, err := encode(ctx, name, m, opts)
+	if err != nil {
+		return false, err
+	}
+	qm.DedupKey = uniqueKey(name, dedupKey)
+	_, created, err := q.SendIdempotentTx(ctx, tx, qm)
+	return created, err
+}
+
+// uniqueKey for the message dedup key of a unique job.
+// The name is quoted, so different name and key combinations can't result in the same dedup key.
+func uniqueKey(name, dedupKey string) string {
+	if dedupKey == "" {
+		panic("dedup key cannot be empty")
+	}
+	return strconv.Quote(name) + dedupKey
+}
+
+// CreateBatch creates messages for the named job in the given queue, one for each of ms, in a single transaction.
+// The jobs are created in the given order. An empty ms is a no-op.
+func CreateBatch(ctx context.Context, q *goqite.Queue, name string, ms [][]byte, opts ...CreateOption) error {
+	var messages []goqite.Message
+	for _, m := range ms {
+		qm, err := encode(ctx, name, m, opts)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, qm)
+	}
+	return q.SendBatch(ctx, messages)
+}
+
+// encode the queue message for the named job, with the job message envelope as the body.
+func encode(ctx context.Context, name string, m []byte, opts []CreateOption) (goqite.Message, error) {
+	var o createOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	body, err := encodeEnvelope(ctx, name, m, o)
+	if err != nil {
+		return goqite.Message{}, err
+	}
+	return goqite.Message{Body: body, Delay: o.delay}, nil
+}
+
+// encodeEnvelope encodes the job message envelope for the named job.
+func encodeEnvelope(ctx context.Context, name string, m []byte, o createOpts) ([]byte, error) {
+	jm := message{Name: name, Message: m, Deadline: o.deadline}
+	if o.propagator != nil {
+		jm.Metadata = map[string]string{}
+		o.propagator.Inject(ctx, jm.Metadata)
+	}
+
+	buf := bytes.NewBuffer(encodeHeader(name))
+	if !o.compress {
+		if err := gob.NewEncoder(buf).Encode(jm); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	w := gzip.NewWriter(buf)
+	if err := gob.NewEncoder(w).Encode(jm); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// headerMagic starts the header of a job message envelope, which has the job name in plain bytes, so messages can be
+// received by job name with a receive filter on the body. See [encodeHeader].
+// Neither gob nor gzip streams start with it, so envelopes without a header, created before it was added, still decode.
+const headerMagic = 0x00
+
+// encodeHeader of a job message envelope for the named job, which is the header magic, the length of the name as an
+// uvarint, and the name. The length makes sure that the header of one name is never a prefix of the header of another.
+func encodeHeader(name string) []byte {
+	header := binary.AppendUvarint([]byte{headerMagic}, uint64(len(name)))
+	return append(header, name...)
+}
+
+// gzipMagic starts every gzip stream. A gob stream of a job message can't start with it, because it starts with the
+// byte count of the envelope type definition, followed by its type ID, which is encoded as 0x7f.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decode a job message envelope, which may be compressed. See [WithCompression].
+func decode(body []byte) (message, error) {
+	var jm message
+	if len(body) > 0 && body[0] == headerMagic {
+		n, size := binary.Uvarint(body[1:])
+		if size <= 0 || uint64(len(body)-1-size) < n {
+			return jm, errors.New("invalid job message header")
+		}
+		body = body[1+size+int(n):]
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, gzipMagic) {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return jm, err
+		}
+		defer func() {
+			_ = gr.Close()
+		}()
+		r = gr
+	}
+	err := gob.NewDecoder(r).Decode(&jm)
+	return jm, err
 }
 
 // logger matches the info level method from the slog.Logger.
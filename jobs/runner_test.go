@@ -1,10 +1,16 @@
 package jobs_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,14 +25,14 @@ import (
 
 func TestRunner_Register(t *testing.T) {
 	t.Run("can register a new job", func(t *testing.T) {
-		r := jobs.NewRunner(jobs.NewRunnerOpts{})
+		_, r := newRunner(t)
 		r.Register("test", func(ctx context.Context, m []byte) error {
 			return nil
 		})
 	})
 
 	t.Run("panics if the same job is registered twice", func(t *testing.T) {
-		r := jobs.NewRunner(jobs.NewRunnerOpts{})
+		_, r := newRunner(t)
 		r.Register("test", func(ctx context.Context, m []byte) error {
 			return nil
 		})
@@ -86,23 +92,69 @@ func TestRunner_Start(t *testing.T) {
 		is.True(t, ranDifferentTest)
 	})
 
-	t.Run("panics if the job is not registered", func(t *testing.T) {
+	t.Run("leaves the message for redelivery if the job is not registered, and keeps running other jobs", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var ran bool
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			ran = true
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "unknown", []byte("yo"))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.True(t, ran)
+
+		ms, err := q.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+		is.Equal(t, 1, ms[0].Received)
+	})
+
+	t.Run("runs the default job if the job is not registered", func(t *testing.T) {
 		q, r := newRunner(t)
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
+		ctx, cancel := context.WithCancel(context.Background())
 
-		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		var ranTest bool
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			ranTest = true
+			return nil
+		})
+
+		var name, message string
+		r.RegisterDefault(func(ctx context.Context, m []byte) error {
+			name = jobs.JobName(ctx)
+			message = string(m)
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "unknown", []byte("yo"))
 		is.NotError(t, err)
 
+		r.Start(ctx)
+		is.True(t, !ranTest)
+		is.Equal(t, "unknown", name)
+		is.Equal(t, "yo", message)
+	})
+
+	t.Run("panics if the default job is registered twice", func(t *testing.T) {
+		_, r := newRunner(t)
+		r.RegisterDefault(func(ctx context.Context, m []byte) error { return nil })
+
 		defer func() {
-			r := recover()
-			if r == nil {
-				t.Fatal("did not panic")
-			}
-			is.Equal(t, `job "test" not registered`, r)
+			is.Equal[any](t, "default job already registered", recover())
 		}()
-		r.Start(ctx)
+		r.RegisterDefault(func(ctx context.Context, m []byte) error { return nil })
 	})
 
 	t.Run("does not panic if job panics", func(t *testing.T) {
@@ -142,6 +194,1214 @@ func TestRunner_Start(t *testing.T) {
 	})
 }
 
+func TestRunner_StartWithStats(t *testing.T) {
+	t.Run("reports completed and abandoned jobs", func(t *testing.T) {
+		q, r := newRunner(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan struct{}, 2)
+		r.Register("complete", func(ctx context.Context, m []byte) error {
+			done <- struct{}{}
+			return nil
+		})
+		started := make(chan struct{})
+		r.Register("abandon", func(ctx context.Context, m []byte) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		for _, name := range []string{"complete", "complete", "abandon"} {
+			err := jobs.Create(ctx, q, name, nil)
+			is.NotError(t, err)
+		}
+
+		go func() {
+			<-started
+			for i := 0; i < 2; i++ {
+				<-done
+			}
+			cancel()
+		}()
+
+		stats := r.StartWithStats(ctx)
+		is.Equal(t, jobs.RunStats{Completed: 2, Abandoned: 1}, stats)
+	})
+}
+
+func TestRunner_Register_WithPool(t *testing.T) {
+	t.Run("bounds the concurrency of each pool independently", func(t *testing.T) {
+		q, r := newRunner(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var lock sync.Mutex
+		running := map[string]int{}
+		maxRunning := map[string]int{}
+		var ran int
+		job := func(pool string) jobs.Func {
+			return func(ctx context.Context, m []byte) error {
+				lock.Lock()
+				running[pool]++
+				maxRunning[pool] = max(maxRunning[pool], running[pool])
+				lock.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				lock.Lock()
+				defer lock.Unlock()
+				running[pool]--
+				ran++
+				if ran == 8 {
+					cancel()
+				}
+				return nil
+			}
+		}
+
+		r.Register("email", job("emails"), jobs.WithPool("emails", 1))
+		r.Register("report", job("reports"), jobs.WithPool("reports", 2))
+
+		for i := 0; i < 4; i++ {
+			err := jobs.Create(ctx, q, "email", nil)
+			is.NotError(t, err)
+			err = jobs.Create(ctx, q, "report", nil)
+			is.NotError(t, err)
+		}
+
+		r.Start(ctx)
+
+		is.Equal(t, 8, ran)
+		is.Equal(t, 1, maxRunning["emails"])
+		is.True(t, maxRunning["reports"] <= 2)
+	})
+
+	t.Run("runs the jobs of other pools right away while one pool is full, without receiving its messages", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Limit: 1, Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var ran atomic.Int32
+		var inFlight int
+		release := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := func() {
+			if ran.Add(1) == 4 {
+				cancel()
+			}
+		}
+		r.Register("slow", func(ctx context.Context, m []byte) error {
+			defer done()
+			if string(m) == "1" {
+				if err := jobs.Create(ctx, q, "fast", nil); err != nil {
+					return err
+				}
+			}
+			<-release
+			return nil
+		}, jobs.WithPool("slow", 1))
+		r.Register("fast", func(ctx context.Context, m []byte) error {
+			defer done()
+			ms, err := q.InFlight(ctx)
+			inFlight = len(ms)
+			close(release)
+			return err
+		}, jobs.WithPool("fast", 1))
+		err := jobs.CreateBatch(ctx, q, "slow", [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, int32(4), ran.Load())
+		// The running slow and fast jobs, and not the slow jobs waiting for the slow pool
+		is.Equal(t, 2, inFlight)
+	})
+
+	t.Run("still runs a job message created before job names were in the message header", func(t *testing.T) {
+		q, r := newRunner(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var got string
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			got = string(m)
+			cancel()
+			return nil
+		}, jobs.WithPool("test", 1))
+
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(struct {
+			Name    string
+			Message []byte
+		}{Name: "test", Message: []byte("yo")})
+		is.NotError(t, err)
+		err = q.Send(ctx, goqite.Message{Body: buf.Bytes()})
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, "yo", got)
+	})
+
+	t.Run("panics if the default job is registered with a pool", func(t *testing.T) {
+		_, r := newRunner(t)
+
+		defer func() {
+			is.Equal[any](t, "default job cannot be run in a pool", recover())
+		}()
+		r.RegisterDefault(func(ctx context.Context, m []byte) error { return nil }, jobs.WithPool("default", 1))
+	})
+
+	t.Run("panics if a pool is registered with a different size", func(t *testing.T) {
+		_, r := newRunner(t)
+
+		r.Register("email", func(ctx context.Context, m []byte) error { return nil }, jobs.WithPool("emails", 1))
+
+		defer func() {
+			is.Equal[any](t, `pool "emails" already registered with a different size`, recover())
+		}()
+		r.Register("newsletter", func(ctx context.Context, m []byte) error { return nil }, jobs.WithPool("emails", 2))
+	})
+}
+
+func TestRunner_Register_WithTimeout(t *testing.T) {
+	t.Run("cancels a job exceeding its timeout and releases its message", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: 10 * time.Second}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var runCount atomic.Int32
+		var firstErr error
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			if runCount.Add(1) == 1 {
+				<-ctx.Done()
+				firstErr = ctx.Err()
+				return firstErr
+			}
+			cancel()
+			return nil
+		}, jobs.WithTimeout(50*time.Millisecond))
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		started := time.Now()
+		r.Start(ctx)
+		is.Error(t, context.DeadlineExceeded, firstErr)
+		is.Equal(t, int32(2), runCount.Load())
+		// Re-received long before the message timeout
+		is.True(t, time.Since(started) < time.Second)
+	})
+
+	t.Run("does not count the time waiting for a pool slot towards the timeout", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Limit: 2, Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var ran atomic.Int32
+		var jobErr error
+		var lock sync.Mutex
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			select {
+			case <-ctx.Done():
+				lock.Lock()
+				jobErr = ctx.Err()
+				lock.Unlock()
+			case <-time.After(100 * time.Millisecond):
+			}
+			if ran.Add(1) == 2 {
+				cancel()
+			}
+			return nil
+		}, jobs.WithPool("test", 1), jobs.WithTimeout(150*time.Millisecond))
+
+		for i := 0; i < 2; i++ {
+			err := jobs.Create(ctx, q, "test", []byte("yo"))
+			is.NotError(t, err)
+		}
+
+		r.Start(ctx)
+		is.Equal(t, int32(2), ran.Load())
+		is.NotError(t, jobErr)
+	})
+}
+
+func TestRunner_RegisterTx(t *testing.T) {
+	newRunner := func(t *testing.T) (*sql.DB, *goqite.Queue, *jobs.Runner) {
+		db := internaltesting.NewDB(t, ":memory:")
+		_, err := db.Exec(`create table things (name text not null)`)
+		is.NotError(t, err)
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Timeout: 50 * time.Millisecond}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{DB: db, Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+		return db, q, r
+	}
+
+	t.Run("commits the job changes and the message delete together", func(t *testing.T) {
+		db, q, r := newRunner(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("test", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			defer cancel()
+			_, err := tx.ExecContext(ctx, `insert into things (name) values (?)`, string(m))
+			return err
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		var count int
+		err = db.QueryRow(`select count(*) from things where name = 'yo'`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 1, count)
+
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+	})
+
+	t.Run("rolls back the job changes and keeps the message if the job fails", func(t *testing.T) {
+		db, q, r := newRunner(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("test", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			defer cancel()
+			if _, err := tx.ExecContext(ctx, `insert into things (name) values (?)`, string(m)); err != nil {
+				return err
+			}
+			return errors.New("oh no")
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		var count int
+		err = db.QueryRow(`select count(*) from things`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 1, count)
+	})
+
+	t.Run("panics without a database", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Queue: q})
+
+		defer func() {
+			is.Equal(t, "db cannot be nil when registering tx jobs", recover())
+		}()
+		r.RegisterTx("test", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			return nil
+		})
+	})
+}
+
+func TestRunner_SingleTx(t *testing.T) {
+	newRunner := func(t *testing.T) (*sql.DB, *goqite.Queue, *jobs.Runner) {
+		db := internaltesting.NewDB(t, ":memory:")
+		_, err := db.Exec(`create table things (name text not null)`)
+		is.NotError(t, err)
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Timeout: time.Minute}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			DB:           db,
+			Log:          internaltesting.NewLogger(t),
+			PollInterval: time.Millisecond,
+			Queue:        q,
+			SingleTx:     true,
+		})
+		return db, q, r
+	}
+
+	t.Run("commits the job changes and the message delete on success", func(t *testing.T) {
+		db, q, r := newRunner(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("test", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			defer cancel()
+			_, err := tx.ExecContext(ctx, `insert into things (name) values (?)`, string(m))
+			return err
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		stats := r.StartWithStats(ctx)
+		is.Equal(t, jobs.RunStats{Completed: 1}, stats)
+
+		var count int
+		err = db.QueryRow(`select count(*) from things where name = 'yo'`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 1, count)
+
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+	})
+
+	t.Run("rolls back the job changes but keeps the message lease on failure", func(t *testing.T) {
+		db, q, r := newRunner(t)
+
+		var runs int
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("fail", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			runs++
+			if _, err := tx.ExecContext(ctx, `insert into things (name) values (?)`, string(m)); err != nil {
+				return err
+			}
+			return errors.New("oh no")
+		})
+		r.RegisterTx("panic", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			defer cancel()
+			if _, err := tx.ExecContext(ctx, `insert into things (name) values (?)`, string(m)); err != nil {
+				return err
+			}
+			panic("oh no")
+		})
+
+		err := jobs.Create(ctx, q, "fail", []byte("yo"))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, q, "panic", []byte("yo"))
+		is.NotError(t, err)
+
+		stats := r.StartWithStats(ctx)
+		is.Equal(t, jobs.RunStats{Failed: 1, Panicked: 1}, stats)
+		is.Equal(t, 1, runs)
+
+		var count int
+		err = db.QueryRow(`select count(*) from things`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+
+		ms, err := q.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 2, len(ms))
+		is.Equal(t, 1, ms[0].Received)
+		is.Equal(t, 1, ms[1].Received)
+	})
+
+	t.Run("can create another job in the transaction", func(t *testing.T) {
+		db, q, r := newRunner(t)
+
+		var ran []string
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("first", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			ran = append(ran, "first")
+			return jobs.CreateTx(ctx, tx, q, "second", nil)
+		})
+		r.RegisterTx("second", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			defer cancel()
+			ran = append(ran, "second")
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "first", nil)
+		is.NotError(t, err)
+
+		stats := r.StartWithStats(ctx)
+		is.Equal(t, jobs.RunStats{Completed: 2}, stats)
+		is.Equal(t, "first second", strings.Join(ran, " "))
+
+		var count int
+		err = db.QueryRow(`select count(*) from goqite`).Scan(&count)
+		is.NotError(t, err)
+		is.Equal(t, 0, count)
+	})
+
+	t.Run("panics when registering a job that doesn't get the transaction", func(t *testing.T) {
+		_, _, r := newRunner(t)
+
+		defer func() {
+			is.Equal[any](t, "jobs must be registered with RegisterTx with single tx", recover())
+		}()
+		r.Register("test", func(ctx context.Context, m []byte) error { return nil })
+	})
+
+	t.Run("panics when registering a default job", func(t *testing.T) {
+		_, _, r := newRunner(t)
+
+		defer func() {
+			is.Equal[any](t, "jobs must be registered with RegisterTx with single tx", recover())
+		}()
+		r.RegisterDefault(func(ctx context.Context, m []byte) error { return nil })
+	})
+}
+
+func TestRunner_MaxRunDuration(t *testing.T) {
+	t.Run("stops extending and calls the callback for a job that runs too long", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: 100 * time.Millisecond}, ":memory:")
+
+		var called atomic.Int32
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Extend:         50 * time.Millisecond,
+			Limit:          2,
+			Log:            internaltesting.NewLogger(t),
+			MaxRunDuration: 100 * time.Millisecond,
+			OnLongRunning: func(name string, id goqite.ID, d time.Duration) {
+				called.Add(1)
+				is.Equal(t, "test", name)
+				is.True(t, id != "")
+				is.True(t, d > 100*time.Millisecond)
+			},
+			PollInterval: 10 * time.Millisecond,
+			Queue:        q,
+		})
+
+		var runCount atomic.Int32
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			// The message becomes visible again and is re-received after the extension stops
+			if runCount.Add(1) == 2 {
+				cancel()
+				return nil
+			}
+			time.Sleep(400 * time.Millisecond)
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, int32(1), called.Load())
+		is.Equal(t, int32(2), runCount.Load())
+	})
+}
+
+func TestRunner_MaxPollInterval(t *testing.T) {
+	t.Run("grows the poll interval while idle and resets it when a job is received", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+
+		var lock sync.Mutex
+		var intervals []time.Duration
+		log := internaltesting.NewLogger(t)
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log: internaltesting.Logger(func(msg string, args ...any) {
+				if msg == "No jobs, increasing poll interval" {
+					lock.Lock()
+					intervals = append(intervals, args[1].(time.Duration))
+					lock.Unlock()
+				}
+				log.Info(msg, args...)
+			}),
+			MaxPollInterval: 40 * time.Millisecond,
+			PollInterval:    10 * time.Millisecond,
+			Queue:           q,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			return nil
+		})
+
+		go func() {
+			time.Sleep(150 * time.Millisecond)
+			err := jobs.Create(ctx, q, "test", []byte("yo"))
+			is.NotError(t, err)
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+
+		r.Start(ctx)
+
+		lock.Lock()
+		defer lock.Unlock()
+		is.True(t, len(intervals) >= 3)
+		is.Equal(t, 20*time.Millisecond, intervals[0])
+		is.Equal(t, 40*time.Millisecond, intervals[1])
+		is.Equal(t, 20*time.Millisecond, intervals[2])
+	})
+}
+
+func TestRunner_PoisonThreshold(t *testing.T) {
+	t.Run("warns about a repeatedly failing job message", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{MaxReceive: 3, Timeout: 10 * time.Millisecond}, ":memory:")
+
+		var warnings atomic.Int32
+		log := internaltesting.NewLogger(t)
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log: internaltesting.Logger(func(msg string, args ...any) {
+				if msg == "Warning: possible poison message, received many times" {
+					warnings.Add(1)
+				}
+				log.Info(msg, args...)
+			}),
+			PoisonThreshold: 0.5,
+			PollInterval:    time.Millisecond,
+			Queue:           q,
+		})
+
+		var runCount atomic.Int32
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			if runCount.Add(1) == 3 {
+				cancel()
+			}
+			return errors.New("oh no")
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, int32(3), runCount.Load())
+		is.Equal(t, int32(2), warnings.Load())
+	})
+}
+
+func TestRunner_Queues(t *testing.T) {
+	t.Run("runs jobs from multiple queues", func(t *testing.T) {
+		db := internaltesting.NewDB(t, ":memory:")
+		emails := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "emails"}, ":memory:")
+		reports := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "reports"}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log:          internaltesting.NewLogger(t),
+			PollInterval: time.Millisecond,
+			Queue:        emails,
+			Queues:       []*goqite.Queue{reports},
+		})
+
+		var emailsRan, reportsRan atomic.Bool
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("email", func(ctx context.Context, m []byte) error {
+			emailsRan.Store(true)
+			if reportsRan.Load() {
+				cancel()
+			}
+			return nil
+		})
+		r.Register("report", func(ctx context.Context, m []byte) error {
+			reportsRan.Store(true)
+			if emailsRan.Load() {
+				cancel()
+			}
+			return nil
+		})
+
+		err := jobs.Create(ctx, emails, "email", []byte("yo"))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, reports, "report", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.True(t, emailsRan.Load())
+		is.True(t, reportsRan.Load())
+
+		// Both messages are deleted from their own queues after the jobs ran
+		for _, q := range []*goqite.Queue{emails, reports} {
+			n, err := q.ApproxLen(context.Background())
+			is.NotError(t, err)
+			is.Equal(t, 0, n)
+		}
+	})
+
+	t.Run("polls the queues in round-robin order", func(t *testing.T) {
+		db := internaltesting.NewDB(t, ":memory:")
+		a := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "a"}, ":memory:")
+		b := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "b"}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Limit:        1,
+			Log:          internaltesting.NewLogger(t),
+			PollInterval: time.Millisecond,
+			Queues:       []*goqite.Queue{a, b},
+		})
+
+		var ran []string
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			ran = append(ran, string(m))
+			if len(ran) == 4 {
+				cancel()
+			}
+			return nil
+		})
+
+		err := jobs.CreateBatch(ctx, a, "test", [][]byte{[]byte("a1"), []byte("a2")})
+		is.NotError(t, err)
+		err = jobs.CreateBatch(ctx, b, "test", [][]byte{[]byte("b1"), []byte("b2")})
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, "a1 b1 a2 b2", strings.Join(ran, " "))
+	})
+
+	t.Run("only runs a job registered with a queue from that queue", func(t *testing.T) {
+		db := internaltesting.NewDB(t, ":memory:")
+		a := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "a"}, ":memory:")
+		b := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "b"}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log:          internaltesting.NewLogger(t),
+			PollInterval: time.Millisecond,
+			Queues:       []*goqite.Queue{a, b},
+		})
+
+		var ran []string
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			ran = append(ran, string(m))
+			return nil
+		}, jobs.WithQueue(a))
+		r.Register("done", func(ctx context.Context, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, b, "test", []byte("b"))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, a, "test", []byte("a"))
+		is.NotError(t, err)
+		err = jobs.CreateBatch(ctx, b, "done", [][]byte{nil, nil})
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, "a", strings.Join(ran, " "))
+
+		ms, err := b.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+	})
+
+	t.Run("panics if no queue", func(t *testing.T) {
+		defer func() {
+			is.Equal[any](t, "queue or queues must be set", recover())
+		}()
+		jobs.NewRunner(jobs.NewRunnerOpts{})
+	})
+
+	t.Run("panics if registered with a queue that is not one of the runner queues", func(t *testing.T) {
+		db := internaltesting.NewDB(t, ":memory:")
+		a := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "a"}, ":memory:")
+		b := internaltesting.NewQ(t, goqite.NewOpts{DB: db, Name: "b"}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Queue: a})
+
+		defer func() {
+			is.Equal[any](t, `queue "b" is not one of the runner queues`, recover())
+		}()
+		r.Register("test", func(ctx context.Context, m []byte) error { return nil }, jobs.WithQueue(b))
+	})
+}
+
+func TestRunner_Log(t *testing.T) {
+	t.Run("logs the same fields first for a job", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Name: "jobs"}, ":memory:")
+
+		var lock sync.Mutex
+		logged := map[string][]any{}
+		log := internaltesting.NewLogger(t)
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log: internaltesting.Logger(func(msg string, args ...any) {
+				lock.Lock()
+				logged[msg] = args
+				lock.Unlock()
+				log.Info(msg, args...)
+			}),
+			PollInterval: 10 * time.Millisecond,
+			Queue:        q,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", nil)
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, msg := range []string{"Running job", "Ran job"} {
+			args := logged[msg]
+			is.True(t, len(args) >= 8)
+			is.Equal[any](t, "queue", args[0])
+			is.Equal[any](t, "jobs", args[1])
+			is.Equal[any](t, "job", args[2])
+			is.Equal[any](t, "test", args[3])
+			is.Equal[any](t, "id", args[4])
+			id, ok := args[5].(goqite.ID)
+			is.True(t, ok && strings.HasPrefix(string(id), "m_"))
+			is.Equal[any](t, "attempt", args[6])
+			is.Equal[any](t, 1, args[7])
+		}
+		is.Equal[any](t, "duration", logged["Ran job"][8])
+	})
+}
+
+func TestRunner_DeleteTimeout(t *testing.T) {
+	t.Run("uses the delete timeout for the message delete", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Minute}, ":memory:")
+
+		var deleteErr error
+		log := internaltesting.NewLogger(t)
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			DeleteTimeout: time.Nanosecond,
+			Log: internaltesting.Logger(func(msg string, args ...any) {
+				if msg == "Error deleting job from queue, it will be retried" {
+					deleteErr = args[len(args)-1].(error)
+				}
+				log.Info(msg, args...)
+			}),
+			PollInterval: time.Millisecond,
+			Queue:        q,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", nil)
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Error(t, context.DeadlineExceeded, deleteErr)
+
+		ms, err := q.InFlight(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 1, len(ms))
+	})
+
+	t.Run("panics if negative", func(t *testing.T) {
+		defer func() {
+			is.Equal[any](t, "delete timeout cannot be negative", recover())
+		}()
+		jobs.NewRunner(jobs.NewRunnerOpts{DeleteTimeout: -1})
+	})
+}
+
+func TestRunner_SlowThreshold(t *testing.T) {
+	t.Run("logs a warning for a job that runs longer than the threshold", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+
+		var slow atomic.Int32
+		log := internaltesting.NewLogger(t)
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log: internaltesting.Logger(func(msg string, args ...any) {
+				if msg == "Warning: job ran slowly" {
+					slow.Add(1)
+					is.Equal(t, "job", args[2])
+					is.Equal(t, "test", args[3])
+				}
+				log.Info(msg, args...)
+			}),
+			PollInterval:  10 * time.Millisecond,
+			Queue:         q,
+			SlowThreshold: 10 * time.Millisecond,
+		})
+
+		var runCount atomic.Int32
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			if string(m) == "slow" {
+				time.Sleep(20 * time.Millisecond)
+			}
+			if runCount.Add(1) == 2 {
+				cancel()
+			}
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("slow"))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, q, "test", []byte("fast"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, int32(1), slow.Load())
+	})
+}
+
+func TestRunner_StartupDelay(t *testing.T) {
+	t.Run("does not receive before the startup delay has passed", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			Log:           internaltesting.NewLogger(t),
+			PollInterval:  time.Millisecond,
+			Queue:         q,
+			StartupDelay:  100 * time.Millisecond,
+			StartupJitter: 10 * time.Millisecond,
+		})
+
+		var ranAfter time.Duration
+		started := time.Now()
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			ranAfter = time.Since(started)
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.True(t, ranAfter >= 100*time.Millisecond)
+	})
+}
+
+func TestRunner_ReleaseOnShutdown(t *testing.T) {
+	t.Run("releases the message of a job interrupted by shutdown", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Second}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), Queue: q, ReleaseOnShutdown: true})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.NotNil(t, m)
+	})
+
+	t.Run("does not release the message of a job that finished", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Second}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), Queue: q, ReleaseOnShutdown: true})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("does not release the message without the option", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Second}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), Queue: q})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+type traceIDKey struct{}
+
+type traceIDPropagator struct{}
+
+func (p traceIDPropagator) Inject(ctx context.Context, metadata map[string]string) {
+	if id, ok := ctx.Value(traceIDKey{}).(string); ok {
+		metadata["trace_id"] = id
+	}
+}
+
+func (p traceIDPropagator) Extract(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, metadata["trace_id"])
+}
+
+func TestCreate_WithPropagator(t *testing.T) {
+	t.Run("propagates a value from the creating context to the job context", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), Propagator: traceIDPropagator{}, Queue: q})
+
+		var traceID any
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			traceID = ctx.Value(traceIDKey{})
+			cancel()
+			return nil
+		})
+
+		createCtx := context.WithValue(context.Background(), traceIDKey{}, "abc123")
+		err := jobs.Create(createCtx, q, "test", []byte("yo"), jobs.WithPropagator(traceIDPropagator{}))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, "abc123", traceID)
+	})
+}
+
+func TestCreate_WithDeadline(t *testing.T) {
+	t.Run("cancels the job context at the deadline", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var jobErr error
+		var ranFor time.Duration
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			defer cancel()
+			started := time.Now()
+			select {
+			case <-ctx.Done():
+				jobErr = ctx.Err()
+			case <-time.After(time.Second):
+			}
+			ranFor = time.Since(started)
+			return jobErr
+		})
+
+		err := jobs.Create(ctx, q, "test", []byte("yo"), jobs.WithDeadline(time.Now().Add(100*time.Millisecond)))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Error(t, context.DeadlineExceeded, jobErr)
+		is.True(t, ranFor < time.Second)
+	})
+
+	t.Run("deletes the message without running the job if the deadline has passed", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var expiredRan bool
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("expired", func(ctx context.Context, m []byte) error {
+			expiredRan = true
+			return nil
+		})
+		r.Register("done", func(ctx context.Context, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "expired", []byte("yo"), jobs.WithDeadline(time.Now().Add(-time.Second)))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, q, "done", []byte("yo"))
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.True(t, !expiredRan)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+
+	t.Run("deletes the message without running the job if the deadline has passed, in a single tx", func(t *testing.T) {
+		db := internaltesting.NewDB(t, ":memory:")
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{
+			DB:           db,
+			Log:          internaltesting.NewLogger(t),
+			PollInterval: time.Millisecond,
+			Queue:        q,
+			SingleTx:     true,
+		})
+
+		var expiredRan bool
+		ctx, cancel := context.WithCancel(context.Background())
+		r.RegisterTx("expired", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			expiredRan = true
+			return nil
+		})
+		r.RegisterTx("done", func(ctx context.Context, tx *sql.Tx, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "expired", []byte("yo"), jobs.WithDeadline(time.Now().Add(-time.Second)))
+		is.NotError(t, err)
+		err = jobs.Create(ctx, q, "done", []byte("yo"))
+		is.NotError(t, err)
+
+		stats := r.StartWithStats(ctx)
+		is.True(t, !expiredRan)
+		is.Equal(t, jobs.RunStats{Completed: 1}, stats)
+
+		n, err := q.ApproxLen(context.Background())
+		is.NotError(t, err)
+		is.Equal(t, 0, n)
+	})
+}
+
+func TestCreate_WithCompression(t *testing.T) {
+	t.Run("round-trips a large compressed payload", func(t *testing.T) {
+		db := internaltesting.NewDB(t, ":memory:")
+		q := internaltesting.NewQ(t, goqite.NewOpts{DB: db}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), Queue: q})
+
+		payload := bytes.Repeat([]byte("yo"), 512*1024)
+
+		var got []byte
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			got = m
+			cancel()
+			return nil
+		})
+
+		err := jobs.Create(ctx, q, "test", payload, jobs.WithCompression())
+		is.NotError(t, err)
+
+		var size int
+		err = db.QueryRow(`select length(body) from goqite`).Scan(&size)
+		is.NotError(t, err)
+		is.True(t, size < len(payload)/10)
+
+		r.Start(ctx)
+		is.True(t, bytes.Equal(payload, got))
+	})
+}
+
+type typedPayload struct {
+	Name  string
+	Count int
+}
+
+func TestRegisterTyped(t *testing.T) {
+	t.Run("can round-trip a typed payload through the runner", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), Queue: q})
+
+		var got typedPayload
+		ctx, cancel := context.WithCancel(context.Background())
+		jobs.RegisterTyped(r, "test", func(ctx context.Context, v typedPayload) error {
+			got = v
+			cancel()
+			return nil
+		})
+
+		err := jobs.CreateTyped(ctx, q, "test", typedPayload{Name: "yo", Count: 2})
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, typedPayload{Name: "yo", Count: 2}, got)
+	})
+
+	t.Run("drops a message that cannot be decoded", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: time.Millisecond}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var called bool
+		jobs.RegisterTyped(r, "test", func(ctx context.Context, v typedPayload) error {
+			called = true
+			return nil
+		})
+
+		err := jobs.Create(context.Background(), q, "test", []byte("not gob"))
+		is.NotError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		r.Start(ctx)
+		is.True(t, !called)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestCreateBatch(t *testing.T) {
+	t.Run("can create a batch of jobs that all run in order", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Limit: 1, Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var ran []string
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("test", func(ctx context.Context, m []byte) error {
+			ran = append(ran, string(m))
+			if len(ran) == 3 {
+				cancel()
+			}
+			return nil
+		})
+
+		err := jobs.CreateBatch(ctx, q, "test", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, "a b c", strings.Join(ran, " "))
+	})
+
+	t.Run("does nothing with an empty batch", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := jobs.CreateBatch(context.Background(), q, "test", nil)
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+func TestCreateUnique(t *testing.T) {
+	t.Run("creates only one pending job with the same name and dedup key", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Limit: 1, Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+
+		var ran []string
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Register("rebuild", func(ctx context.Context, m []byte) error {
+			ran = append(ran, string(m))
+			return nil
+		})
+		r.Register("stop", func(ctx context.Context, m []byte) error {
+			cancel()
+			return nil
+		})
+
+		created, err := jobs.CreateUnique(ctx, q, "rebuild", []byte("a"), "index")
+		is.NotError(t, err)
+		is.True(t, created)
+
+		created, err = jobs.CreateUnique(ctx, q, "rebuild", []byte("b"), "index")
+		is.NotError(t, err)
+		is.True(t, !created)
+
+		created, err = jobs.CreateUnique(ctx, q, "rebuild", []byte("c"), "other")
+		is.NotError(t, err)
+		is.True(t, created)
+
+		err = jobs.Create(ctx, q, "stop", nil)
+		is.NotError(t, err)
+
+		r.Start(ctx)
+		is.Equal(t, "a c", strings.Join(ran, " "))
+
+		created, err = jobs.CreateUnique(context.Background(), q, "rebuild", []byte("d"), "index")
+		is.NotError(t, err)
+		is.True(t, created)
+	})
+
+	t.Run("does not mix up names and dedup keys", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+
+		created, err := jobs.CreateUnique(context.Background(), q, "a", nil, "bc")
+		is.NotError(t, err)
+		is.True(t, created)
+
+		created, err = jobs.CreateUnique(context.Background(), q, "ab", nil, "c")
+		is.NotError(t, err)
+		is.True(t, created)
+	})
+}
+
 func TestCreateTx(t *testing.T) {
 	t.Run("can create a job inside a transaction", func(t *testing.T) {
 		db := internaltesting.NewDB(t, ":memory:")
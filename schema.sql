@@ -1,15 +1,60 @@
-create table goqite (
+create table if not exists goqite (
   id text primary key default ('m_' || lower(hex(randomblob(16)))),
   created text not null default (strftime('%Y-%m-%dT%H:%M:%fZ')),
   updated text not null default (strftime('%Y-%m-%dT%H:%M:%fZ')),
   queue text not null,
   body blob not null,
   timeout text not null default (strftime('%Y-%m-%dT%H:%M:%fZ')),
-  received integer not null default 0
+  received integer not null default 0,
+  dedup_key text,
+  producer text not null default '',
+  deleted text,
+  body_hash text,
+  heartbeat text,
+  checksum integer
 ) strict;
 
-create trigger goqite_updated_timestamp after update on goqite begin
+create trigger if not exists goqite_updated_timestamp after update on goqite begin
   update goqite set updated = strftime('%Y-%m-%dT%H:%M:%fZ') where id = old.id;
 end;
 
-create index goqite_queue_created_idx on goqite (queue, created);
+-- Receiving filters on queue and orders by created, so this index backs the receive subquery.
+-- See BenchmarkQueue in goqite_test.go for a comparison of index alternatives on a big table with multiple queues.
+create index if not exists goqite_queue_created_idx on goqite (queue, created);
+
+create unique index if not exists goqite_queue_dedup_key_idx on goqite (queue, dedup_key) where dedup_key is not null;
+
+-- Tombstones of deleted messages, see NewOpts.Tombstone, backing compaction.
+create index if not exists goqite_queue_deleted_idx on goqite (queue, deleted) where deleted is not null;
+
+-- Body hashes of messages, see NewOpts.DedupBody, backing body deduplication.
+create index if not exists goqite_queue_body_hash_idx on goqite (queue, body_hash) where body_hash is not null;
+
+-- Consumer heartbeats of in-flight messages, see Queue.Heartbeat, backing lease reaping.
+create index if not exists goqite_queue_heartbeat_idx on goqite (queue, heartbeat) where heartbeat is not null;
+
+-- Message counts per queue, maintained by triggers for cheap queue length lookups.
+create table if not exists goqite_lengths (
+  queue text primary key,
+  length integer not null default 0
+) strict;
+
+create trigger if not exists goqite_lengths_insert after insert on goqite begin
+  insert into goqite_lengths (queue, length) values (new.queue, 1)
+  on conflict (queue) do update set length = length + 1;
+end;
+
+create trigger if not exists goqite_lengths_delete after delete on goqite when old.deleted is null begin
+  update goqite_lengths set length = length - 1 where queue = old.queue;
+end;
+
+create trigger if not exists goqite_lengths_tombstone after update of deleted on goqite
+when old.deleted is null and new.deleted is not null begin
+  update goqite_lengths set length = length - 1 where queue = old.queue;
+end;
+
+create trigger if not exists goqite_lengths_update after update of queue on goqite when old.queue != new.queue begin
+  update goqite_lengths set length = length - 1 where queue = old.queue;
+  insert into goqite_lengths (queue, length) values (new.queue, 1)
+  on conflict (queue) do update set length = length + 1;
+end;
@@ -0,0 +1,103 @@
+// Package webhooks delivers webhooks with a [jobs.Runner], turning a queue into a delayed webhook scheduler.
+//
+// [Create] creates a webhook job with a target URL and a body, optionally delayed with [jobs.WithDelay].
+// When the job is run, the body is sent to the URL in a POST request. A response status code other than 2xx
+// is a failure, so the webhook is retried after the queue message timeout, up to the queue max receive count.
+// Register the webhook job on the runner with [Register].
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/maragudk/goqite"
+	"github.com/maragudk/goqite/jobs"
+)
+
+// JobName is the name of the webhook job.
+const JobName = "goqite-webhook"
+
+// Webhook to deliver.
+//   - [Webhook.URL] is where the body is sent. It must be an http or https URL.
+//   - [Webhook.ContentType] is the Content-Type header of the request, which defaults to application/octet-stream.
+//   - [Webhook.Body] is the request body.
+type Webhook struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Create a webhook job in the given queue. The job options are passed to [jobs.Create].
+func Create(ctx context.Context, q *goqite.Queue, w Webhook, opts ...jobs.CreateOption) error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid webhook URL: must be an absolute http or https URL")
+	}
+
+	m, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return jobs.Create(ctx, q, JobName, m, opts...)
+}
+
+// RegisterOpts are options for [Register].
+//   - [RegisterOpts.Client] is the client used to send webhooks, which defaults to [http.DefaultClient].
+//     Set a client timeout that is well below the queue message timeout.
+type RegisterOpts struct {
+	Client *http.Client
+}
+
+// Register the webhook job on the runner r. The register options are passed to [jobs.Runner.Register].
+func Register(r *jobs.Runner, opts RegisterOpts, registerOpts ...jobs.RegisterOption) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	r.Register(JobName, func(ctx context.Context, m []byte) error {
+		var w Webhook
+		if err := json.Unmarshal(m, &w); err != nil {
+			return fmt.Errorf("error decoding webhook: %w", err)
+		}
+		return deliver(ctx, opts.Client, w)
+	}, registerOpts...)
+}
+
+// deliver the webhook w, returning an error if the response status code is not 2xx.
+func deliver(ctx context.Context, c *http.Client, w Webhook) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(w.Body))
+	if err != nil {
+		return err
+	}
+
+	contentType := w.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	// Read the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("error delivering webhook, got status %v", res.StatusCode)
+	}
+	return nil
+}
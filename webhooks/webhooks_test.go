@@ -0,0 +1,107 @@
+package webhooks_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maragudk/is"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/maragudk/goqite"
+	internaltesting "github.com/maragudk/goqite/internal/testing"
+	"github.com/maragudk/goqite/jobs"
+	"github.com/maragudk/goqite/webhooks"
+)
+
+func TestRegister(t *testing.T) {
+	t.Run("delivers the webhook body to the URL", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var body, contentType string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+			contentType = r.Header.Get("Content-Type")
+		}))
+		defer s.Close()
+
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+		webhooks.Register(r, webhooks.RegisterOpts{Client: s.Client()})
+
+		err := webhooks.Create(ctx, q, webhooks.Webhook{URL: s.URL, ContentType: "application/json", Body: []byte(`{"yo":1}`)})
+		is.NotError(t, err)
+		go cancelWhenEmpty(q, cancel)
+
+		stats := r.StartWithStats(ctx)
+		is.Equal(t, jobs.RunStats{Completed: 1}, stats)
+		is.Equal(t, `{"yo":1}`, body)
+		is.Equal(t, "application/json", contentType)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+
+	t.Run("retries the webhook after a non-2xx response", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var requests atomic.Int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}))
+		defer s.Close()
+
+		q := internaltesting.NewQ(t, goqite.NewOpts{Timeout: 10 * time.Millisecond}, ":memory:")
+		r := jobs.NewRunner(jobs.NewRunnerOpts{Log: internaltesting.NewLogger(t), PollInterval: time.Millisecond, Queue: q})
+		webhooks.Register(r, webhooks.RegisterOpts{Client: s.Client()})
+
+		err := webhooks.Create(ctx, q, webhooks.Webhook{URL: s.URL})
+		is.NotError(t, err)
+		go cancelWhenEmpty(q, cancel)
+
+		stats := r.StartWithStats(ctx)
+		is.Equal(t, jobs.RunStats{Failed: 1, Completed: 1}, stats)
+		is.Equal(t, int32(2), requests.Load())
+	})
+}
+
+func TestCreate(t *testing.T) {
+	t.Run("errors on an invalid URL", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+
+		for _, u := range []string{"", "/path", "ftp://example.com", "http://"} {
+			err := webhooks.Create(context.Background(), q, webhooks.Webhook{URL: u})
+			is.True(t, err != nil)
+		}
+	})
+
+	t.Run("delays the webhook with jobs.WithDelay", func(t *testing.T) {
+		q := internaltesting.NewQ(t, goqite.NewOpts{}, ":memory:")
+
+		err := webhooks.Create(context.Background(), q, webhooks.Webhook{URL: "https://example.com"}, jobs.WithDelay(time.Minute))
+		is.NotError(t, err)
+
+		m, err := q.Receive(context.Background())
+		is.NotError(t, err)
+		is.Nil(t, m)
+	})
+}
+
+// cancelWhenEmpty calls cancel when the queue is empty, which is when the webhook has been delivered.
+func cancelWhenEmpty(q *goqite.Queue, cancel context.CancelFunc) {
+	for {
+		if n, err := q.ApproxLen(context.Background()); err == nil && n == 0 {
+			cancel()
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}